@@ -0,0 +1,306 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/maruel/pre-commit-go/checks"
+)
+
+// baselineFileName is the file, at the root of the checkout, listing the
+// known findings that do not fail the checks. It is meant to be checked in.
+const baselineFileName = "pre-commit-go.baseline.json"
+
+// baselineFile is the content of the baseline file.
+type baselineFile struct {
+	Findings []baselineEntry `json:"findings"`
+}
+
+// baselineChecks are the checks whose findings can be recorded in the
+// baseline, the lint and format ones. The failures of the other checks, e.g. a
+// broken test, are never ignored.
+var baselineChecks = map[string]bool{
+	"errcheck":  true,
+	"gofmt":     true,
+	"goimports": true,
+	"golint":    true,
+	"govet":     true,
+}
+
+// baselineKey identifies a finding. It doesn't include the line number, so
+// that a finding still matches when lines are added or removed above it; the
+// content of the line is used instead.
+type baselineKey struct {
+	Check   string `json:"check"`
+	File    string `json:"file,omitempty"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+	Code    string `json:"code,omitempty"`
+}
+
+// baselineEntry is a known finding.
+type baselineEntry struct {
+	baselineKey
+	// Count is the number of identical findings, e.g. the same mistake on
+	// multiple identical lines of a file.
+	Count int `json:"count"`
+}
+
+type entriesByKey []baselineEntry
+
+func (e entriesByKey) Len() int      { return len(e) }
+func (e entriesByKey) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e entriesByKey) Less(i, j int) bool {
+	a, b := e[i].baselineKey, e[j].baselineKey
+	if a.Check != b.Check {
+		return a.Check < b.Check
+	}
+	if a.File != b.File {
+		return a.File < b.File
+	}
+	if a.Rule != b.Rule {
+		return a.Rule < b.Rule
+	}
+	if a.Message != b.Message {
+		return a.Message < b.Message
+	}
+	return a.Code < b.Code
+}
+
+// baseline is the known findings, which are removed from the results of the
+// checks.
+type baseline struct {
+	path string
+
+	lock    sync.Mutex
+	entries map[baselineKey]int
+	// matched is how many findings matched each entry during the run.
+	matched map[baselineKey]int
+	// compared is the checks whose findings were all compared to the baseline
+	// during the run.
+	compared map[string]bool
+	// lines caches the content of the files the findings are about.
+	lines map[string][]string
+}
+
+// loadBaseline loads the baseline file path. It returns nil if the file
+// doesn't exist.
+func loadBaseline(path string) (*baseline, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f := &baselineFile{}
+	if err := json.Unmarshal(content, f); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	b := newBaseline(path)
+	for _, e := range f.Findings {
+		if !baselineChecks[e.Check] {
+			// Recorded by an older version, they are not ignored anymore.
+			continue
+		}
+		b.entries[e.baselineKey] += e.Count
+	}
+	return b, nil
+}
+
+func newBaseline(path string) *baseline {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	b := &baseline{path: path, entries: map[baselineKey]int{}}
+	b.reset()
+	return b
+}
+
+// reset forgets what was matched by a previous run.
+func (b *baseline) reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.matched = map[baselineKey]int{}
+	b.compared = map[string]bool{}
+	b.lines = map[string][]string{}
+}
+
+// key returns the key of finding f of check. It must be called with the lock
+// held.
+func (b *baseline) key(check string, f *checks.Finding) baselineKey {
+	k := baselineKey{Check: check, File: f.File, Rule: f.Rule, Message: f.Message}
+	if f.File != "" && f.Line != 0 {
+		lines, ok := b.lines[f.File]
+		if !ok {
+			if content, err := ioutil.ReadFile(filepath.FromSlash(f.File)); err == nil {
+				lines = strings.Split(string(content), "\n")
+			}
+			b.lines[f.File] = lines
+		}
+		if f.Line <= len(lines) {
+			k.Code = strings.TrimSpace(lines[f.Line-1])
+		}
+	}
+	return k
+}
+
+// filter removes the known findings from the result r. A check that failed
+// only because of known findings passes.
+func (b *baseline) filter(r *checks.Result) {
+	if !baselineChecks[r.Name] {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if r.Status == checks.Passed {
+		b.compared[r.Name] = true
+		return
+	}
+	failure, ok := r.Err.(*checks.Failure)
+	if r.Status != checks.Failed || !ok || len(failure.Findings) == 0 {
+		// The check failed for another reason, e.g. it couldn't run.
+		return
+	}
+	b.compared[r.Name] = true
+	fresh := []checks.Finding{}
+	for i := range failure.Findings {
+		k := b.key(r.Name, &failure.Findings[i])
+		if b.matched[k] < b.entries[k] {
+			b.matched[k]++
+		} else {
+			fresh = append(fresh, failure.Findings[i])
+		}
+	}
+	if len(fresh) == len(failure.Findings) {
+		return
+	}
+	r.Findings = fresh
+	if len(fresh) == 0 {
+		r.Status = checks.Passed
+		r.Err = nil
+		return
+	}
+	r.Err = &checks.Failure{Summary: failure.Summary, Findings: fresh}
+}
+
+// shrink removes the entries of the checks that ran on the whole tree that
+// were not found anymore, and writes the baseline file if any was removed. It
+// returns the number of findings removed.
+func (b *baseline) shrink() (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	removed := 0
+	for k, count := range b.entries {
+		if b.compared[k.Check] && b.matched[k] < count {
+			removed += count - b.matched[k]
+			if b.matched[k] == 0 {
+				delete(b.entries, k)
+			} else {
+				b.entries[k] = b.matched[k]
+			}
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, b.write()
+}
+
+// write writes the baseline file. It must be called with the lock held.
+func (b *baseline) write() error {
+	f := &baselineFile{Findings: make([]baselineEntry, 0, len(b.entries))}
+	for k, count := range b.entries {
+		f.Findings = append(f.Findings, baselineEntry{k, count})
+	}
+	sort.Sort(entriesByKey(f.Findings))
+	content, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(b.path, append(content, '\n'), 0644)
+}
+
+// writeBaseline runs the enabled checks on the whole tree and records the
+// findings of the lint and format checks as the baseline. The entries of the
+// checks not enabled at this run level, or that failed without findings, are
+// kept. Nothing is recorded if another check fails.
+func writeBaseline(ctx context.Context, name string, opts *options) error {
+	config, err := getConfig(name)
+	if err != nil {
+		return err
+	}
+	old, err := loadBaseline(baselineFileName)
+	if err != nil {
+		return err
+	}
+	opts.baseline = nil
+	result, err := runChecks(ctx, config, opts, nil)
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	failed := 0
+	for _, n := range sortedNames(result.failed) {
+		if !baselineChecks[n] {
+			fmt.Printf("%s\n", result.failed[n])
+			failed++
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d checks failed, fix them before recording the baseline", failed)
+	}
+	b := newBaseline(baselineFileName)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	recorded := map[string]bool{}
+	for _, c := range result.enabled {
+		r := result.results[c.GetName()]
+		if r == nil || !baselineChecks[r.Name] || (r.Status != checks.Passed && len(r.Findings) == 0) {
+			continue
+		}
+		recorded[r.Name] = true
+		for i := range r.Findings {
+			b.entries[b.key(r.Name, &r.Findings[i])]++
+		}
+	}
+	if old != nil {
+		for k, count := range old.entries {
+			if !recorded[k.Check] {
+				b.entries[k] = count
+			}
+		}
+	}
+	if err := b.write(); err != nil {
+		return err
+	}
+	total := 0
+	for _, count := range b.entries {
+		total += count
+	}
+	fmt.Printf("recorded %d findings in %s\n", total, baselineFileName)
+	missing := 0
+	for _, n := range sortedResults(result.results) {
+		if baselineChecks[n] && !recorded[n] {
+			fmt.Printf("%s could not be recorded: %s\n", n, result.output(n))
+			missing++
+		}
+	}
+	if missing != 0 {
+		return fmt.Errorf("%d checks failed without findings", missing)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/pre-commit-go/checks"
+)
+
+func TestBaselineFilter(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "pre-commit-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Error(err)
+		}
+	}()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Error(err)
+		}
+	}()
+	write := func(content string) {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, "foo.go"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	finding := func(line int, msg string) checks.Finding {
+		return checks.Finding{File: "foo.go", Line: line, Severity: checks.Warning, Message: msg, Rule: "naming", Tool: "golint"}
+	}
+
+	// Record the baseline on the original file.
+	write("package foo\n\nvar Foo_bar int\n")
+	b := newBaseline(baselineFileName)
+	known := finding(3, "don't use underscores")
+	b.lock.Lock()
+	b.entries[b.key("golint", &known)]++
+	b.lock.Unlock()
+
+	// Two lines are added above the finding, which moves it.
+	write("package foo\n\n// Bar is bar.\nvar Bar int\nvar Foo_bar int\nvar Foo_baz int\n")
+	data := []struct {
+		check    string
+		findings []checks.Finding
+		// fresh is the findings not in the baseline.
+		fresh []checks.Finding
+	}{
+		// Same code on another line.
+		{"golint", []checks.Finding{finding(5, "don't use underscores")}, nil},
+		// Different code.
+		{"golint", []checks.Finding{finding(6, "don't use underscores")}, []checks.Finding{finding(6, "don't use underscores")}},
+		// Different message.
+		{"golint", []checks.Finding{finding(5, "exported var")}, []checks.Finding{finding(5, "exported var")}},
+		// Only one is known.
+		{"golint", []checks.Finding{finding(5, "don't use underscores"), finding(5, "don't use underscores")}, []checks.Finding{finding(5, "don't use underscores")}},
+		// Another check.
+		{"govet", []checks.Finding{finding(5, "don't use underscores")}, []checks.Finding{finding(5, "don't use underscores")}},
+		// The failures of a check that is not a lint check are never ignored.
+		{"test", []checks.Finding{finding(5, "don't use underscores")}, []checks.Finding{finding(5, "don't use underscores")}},
+	}
+	for i, line := range data {
+		b.reset()
+		r := &checks.Result{
+			Name:     line.check,
+			Status:   checks.Failed,
+			Err:      &checks.Failure{Summary: line.check, Findings: line.findings},
+			Findings: line.findings,
+		}
+		b.filter(r)
+		if len(line.fresh) == 0 {
+			if r.Status != checks.Passed || r.Err != nil {
+				t.Errorf("#%d: expected the check to pass, got %s: %v", i, r.Status, r.Err)
+			}
+			continue
+		}
+		if r.Status != checks.Failed {
+			t.Errorf("#%d: expected the check to fail, got %s", i, r.Status)
+		}
+		if len(r.Findings) != len(line.fresh) {
+			t.Errorf("#%d: got findings %v, expected %v", i, r.Findings, line.fresh)
+			continue
+		}
+		for j := range r.Findings {
+			if r.Findings[j] != line.fresh[j] {
+				t.Errorf("#%d: got finding %v, expected %v", i, r.Findings[j], line.fresh[j])
+			}
+		}
+	}
+
+	// A check failing without findings is left as is.
+	b.reset()
+	r := &checks.Result{Name: "golint", Status: checks.Failed, Err: errors.New("golint not found")}
+	b.filter(r)
+	if r.Status != checks.Failed {
+		t.Errorf("expected the check to still fail, got %s", r.Status)
+	}
+}
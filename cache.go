@@ -0,0 +1,20 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import "os"
+
+// cacheDirName is the directory, relative to the .git directory, that holds
+// the results of the checks that passed. See checks.Cache.
+const cacheDirName = "pre-commit-go.cache"
+
+// cleanCache deletes the cache directory.
+func cleanCache() error {
+	d, err := gitPath(cacheDirName)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(d)
+}
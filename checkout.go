@@ -0,0 +1,130 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/maruel/pre-commit-go/checks"
+)
+
+// checkout is a temporary copy of the tree, materialized from git, where the
+// checks can run without touching the developer's working tree.
+//
+// The copy is put inside a temporary GOPATH at the same import path as the
+// original checkout, so that the packages import each other from the copy.
+type checkout struct {
+	tmpDir    string
+	dir       string
+	oldWd     string
+	oldGOPATH string
+}
+
+// newIndexCheckout materializes the content of the index into a temporary
+// directory and chdir into it.
+func newIndexCheckout() (*checkout, error) {
+	c, err := newCheckout()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.populate(nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newRevCheckout materializes the tree of revision rev into a temporary
+// directory and chdir into it. The index and the working tree are not
+// touched.
+func newRevCheckout(rev string) (*checkout, error) {
+	c, err := newCheckout()
+	if err != nil {
+		return nil, err
+	}
+	// Use a temporary index file to not touch the real one.
+	env := []string{"GIT_INDEX_FILE=" + filepath.Join(c.tmpDir, "index")}
+	if _, err := runGitEnv(env, "read-tree", rev); err != nil {
+		_ = c.close()
+		return nil, err
+	}
+	if err := c.populate(env); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newCheckout creates the temporary GOPATH and the empty directory to hold
+// the copy.
+func newCheckout() (*checkout, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	tmpDir, err := ioutil.TempDir("", "pre-commit-go")
+	if err != nil {
+		return nil, err
+	}
+	// checks.RelToGOPATH() compares path prefixes, which fails if the temporary
+	// directory is reached through a symlink.
+	if tmpDir, err = filepath.EvalSymlinks(tmpDir); err != nil {
+		return nil, err
+	}
+	c := &checkout{tmpDir: tmpDir, oldWd: wd, oldGOPATH: os.Getenv("GOPATH")}
+	rel, err := checks.RelToGOPATH(wd)
+	if err != nil {
+		// Not inside GOPATH, it is at least possible to run the checks that do
+		// not care about import paths.
+		log.Printf("%s; using the directory name as the package path", err)
+		rel = filepath.Base(wd)
+	}
+	c.dir = filepath.Join(tmpDir, "src", rel)
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	return c, nil
+}
+
+// populate copies the content of the index into the checkout then enters it.
+// On failure, the checkout is closed.
+func (c *checkout) populate(env []string) error {
+	// The trailing separator is significant, it makes --prefix a directory.
+	_, err := runGitEnv(env, "checkout-index", "--all", "--force", "--prefix="+c.dir+string(filepath.Separator))
+	if err == nil {
+		err = c.enter()
+	}
+	if err != nil {
+		_ = c.close()
+	}
+	return err
+}
+
+// enter chdir into the copy and prepends the temporary GOPATH.
+func (c *checkout) enter() error {
+	gopath := c.tmpDir
+	if c.oldGOPATH != "" {
+		gopath += string(filepath.ListSeparator) + c.oldGOPATH
+	}
+	if err := os.Setenv("GOPATH", gopath); err != nil {
+		return err
+	}
+	log.Printf("checkout in %s", c.dir)
+	return os.Chdir(c.dir)
+}
+
+// close restores the working directory and GOPATH and deletes the copy.
+func (c *checkout) close() error {
+	err := os.Chdir(c.oldWd)
+	if err2 := os.Setenv("GOPATH", c.oldGOPATH); err == nil {
+		err = err2
+	}
+	if err2 := os.RemoveAll(c.tmpDir); err == nil {
+		err = err2
+	}
+	return err
+}
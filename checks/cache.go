@@ -0,0 +1,382 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package checks
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheVersion is part of every cache key. Change it to invalidate the
+// entries written by older versions.
+const cacheVersion = "2"
+
+// cacheEnv lists the environment variables that change what the checks do.
+//
+// GOPATH is not part of it since the checks in a temporary checkout use a
+// temporary GOPATH; the sources found through it are hashed instead.
+var cacheEnv = []string{"GOROOT", "GOOS", "GOARCH", "GOFLAGS", "GO111MODULE", "CGO_ENABLED"}
+
+// Cache stores the results of the checks that passed, so that a check is not
+// run again on the same sources.
+//
+// An entry is keyed by the check name and configuration, the versions of the
+// tools it runs, the files it is asked to look at and the content of all the
+// files of the tree, not only the Go sources since tests and custom checks may
+// read any file, and of the sources of the packages outside the tree it
+// imports.
+type Cache struct {
+	dir string
+
+	once sync.Once
+	// common is the part of the key shared by all the checks.
+	common string
+	err    error
+}
+
+// cacheEntry is what is stored for a check that passed.
+type cacheEntry struct {
+	Duration time.Duration
+	Tests    []TestCase
+}
+
+// NewCache returns a cache storing its entries in directory dir. The key of
+// the entries depends on the current working directory, which is expected to
+// be the root of the checkout.
+func NewCache(dir string) *Cache {
+	return &Cache{dir: dir}
+}
+
+// Get returns the result of a previous run of check that passed, or nil.
+func (c *Cache) Get(ctx context.Context, check Check, change *Change) *Result {
+	key, err := c.key(ctx, check, change)
+	if err != nil {
+		log.Printf("cache: %s", err)
+		return nil
+	}
+	content, err := ioutil.ReadFile(filepath.Join(c.dir, key))
+	if err != nil {
+		return nil
+	}
+	e := &cacheEntry{}
+	if err := json.Unmarshal(content, e); err != nil {
+		log.Printf("cache: corrupted entry %s: %s", key, err)
+		return nil
+	}
+	return &Result{Name: check.GetName(), Status: Passed, Duration: e.Duration, Tests: e.Tests, Cached: true}
+}
+
+// Put stores the result of a check. Only the checks that passed are stored.
+func (c *Cache) Put(ctx context.Context, check Check, change *Change, r *Result) error {
+	if r.Status != Passed || r.Cached {
+		return nil
+	}
+	key, err := c.key(ctx, check, change)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(&cacheEntry{r.Duration, r.Tests})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	// Write then rename, so that a concurrent Get never reads a partial entry.
+	f, err := ioutil.TempFile(c.dir, key+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(c.dir, key))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// key returns the cache key of check.
+func (c *Cache) key(ctx context.Context, check Check, change *Change) (string, error) {
+	c.once.Do(func() {
+		c.common, c.err = commonKey(ctx)
+	})
+	if c.err != nil {
+		return "", c.err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", c.common, check.GetName())
+	// The check configuration, including the packages of each partition.
+	_, _ = h.Write(checkConfig(check))
+	// The versions of the tools it runs, approximated by their executables.
+	tools := []string{}
+	for _, p := range check.GetPrerequisites() {
+		tools = append(tools, p.HelpCommand[0])
+	}
+	for _, c := range checksOf(check) {
+		if a, ok := c.(checkAdaptor); ok {
+			if custom, ok := a.check.(*CustomCheck); ok && len(custom.Command) != 0 {
+				tools = append(tools, custom.Command[0])
+			}
+		}
+	}
+	for _, tool := range tools {
+		fmt.Fprintf(h, "\x00%s\x00%s", tool, executableVersion(tool))
+	}
+	// The files the check looks at.
+	if change == nil {
+		_, _ = io.WriteString(h, "\x00all")
+	} else {
+		files := append([]string{}, change.Files...)
+		sort.Strings(files)
+		fmt.Fprintf(h, "\x00%d\x00%s", len(files), strings.Join(files, "\x00"))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// commonKey hashes what matters to all the checks: the Go toolchain, the
+// environment and the sources.
+func commonKey(ctx context.Context) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00", cacheVersion)
+	out, _, err := capture(ctx, "go", "version")
+	if err != nil {
+		return "", err
+	}
+	_, _ = io.WriteString(h, out)
+	for _, env := range cacheEnv {
+		fmt.Fprintf(h, "\x00%s=%s", env, os.Getenv(env))
+	}
+	if err := hashSources(ctx, h); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashSources hashes the files of the tree and the sources of the packages
+// outside the tree it imports, transitively. The standard library is covered
+// by the Go version.
+//
+// The files are identified by their git blob ID, so that the files tracked by
+// git and not modified don't have to be read.
+func hashSources(ctx context.Context, h hash.Hash) error {
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	// The blob ID of each file, keyed by its path relative to root with
+	// forward slashes. An empty ID means the file has to be read.
+	files, err := treeFiles(ctx, root)
+	if err != nil {
+		return err
+	}
+	for _, d := range externalDeps(root) {
+		pkg, err := build.ImportDir(d, 0)
+		if pkg == nil {
+			return err
+		}
+		for _, names := range [][]string{pkg.GoFiles, pkg.CgoFiles, pkg.SFiles, pkg.CFiles, pkg.HFiles, pkg.CXXFiles, pkg.SysoFiles} {
+			for _, name := range names {
+				files[filepath.ToSlash(filepath.Join(d, name))] = ""
+			}
+		}
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		id := files[name]
+		if id == "" {
+			if id, err = blobID(filepath.Join(root, filepath.FromSlash(name))); err != nil {
+				if os.IsNotExist(err) {
+					// Deleted but not staged.
+					continue
+				}
+				return err
+			}
+		}
+		fmt.Fprintf(h, "\x00%s\x00%s", name, id)
+	}
+	return nil
+}
+
+// treeFiles returns the files of the tree rooted at root that the checks may
+// read, mapped to their git blob ID when it is known: the files tracked by git
+// and the untracked ones that are not ignored. Outside of a git checkout, e.g.
+// in a temporary copy of the index, it is every file of the tree.
+func treeFiles(ctx context.Context, root string) (map[string]string, error) {
+	files := map[string]string{}
+	top, code, _ := capture(ctx, "git", "rev-parse", "--show-toplevel")
+	if code != 0 || !sameDir(strings.TrimSpace(top), root) {
+		err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if info.Name() == ".git" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel, err := filepath.Rel(root, p)
+			if err == nil {
+				files[filepath.ToSlash(rel)] = ""
+			}
+			return err
+		})
+		return files, err
+	}
+	out, code, err := capture(ctx, "git", "ls-files", "-s", "-z")
+	if code != 0 || err != nil {
+		return nil, fmt.Errorf("git ls-files failed: %s %s", out, err)
+	}
+	for _, line := range strings.Split(out, "\x00") {
+		// "<mode> <object> <stage>\t<file>"
+		items := strings.SplitN(line, "\t", 2)
+		if len(items) != 2 {
+			continue
+		}
+		if fields := strings.Fields(items[0]); len(fields) == 3 {
+			files[items[1]] = fields[1]
+		}
+	}
+	// The files modified since they were staged and the untracked ones are
+	// read.
+	for _, args := range [][]string{{"-m"}, {"--others", "--exclude-standard"}} {
+		out, code, err := capture(ctx, append([]string{"git", "ls-files", "-z"}, args...)...)
+		if code != 0 || err != nil {
+			return nil, fmt.Errorf("git ls-files failed: %s %s", out, err)
+		}
+		for _, name := range strings.Split(out, "\x00") {
+			if name != "" {
+				files[name] = ""
+			}
+		}
+	}
+	return files, nil
+}
+
+// blobID returns the ID git gives to the content of file p, or to the target
+// of the symlink p.
+func blobID(p string) (string, error) {
+	stat, err := os.Lstat(p)
+	if err != nil {
+		return "", err
+	}
+	var content []byte
+	if stat.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		content = []byte(filepath.ToSlash(target))
+	} else if stat.IsDir() {
+		// A submodule, identified by its path only.
+		return "dir", nil
+	} else if content, err = ioutil.ReadFile(p); err != nil {
+		return "", err
+	}
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	_, _ = h.Write(content)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sameDir returns true if the directories a and b are the same, once the
+// symlinks are resolved.
+func sameDir(a, b string) bool {
+	if a == "" {
+		return false
+	}
+	if r, err := filepath.EvalSymlinks(a); err == nil {
+		a = r
+	}
+	if r, err := filepath.EvalSymlinks(b); err == nil {
+		b = r
+	}
+	return filepath.Clean(a) == filepath.Clean(b)
+}
+
+// externalDeps returns the directories of the packages outside the tree
+// rooted at root that the packages of the tree import, transitively. The
+// standard library is skipped.
+func externalDeps(root string) []string {
+	// build.Default doesn't see the GOPATH of a temporary checkout.
+	ctxt := build.Default
+	ctxt.GOPATH = os.Getenv("GOPATH")
+	dirs := []string{}
+	dirs = append(dirs, goDirs(false)...)
+	dirs = append(dirs, goDirs(true)...)
+	queue := []*build.Package{}
+	for _, d := range dirs {
+		if pkg, _ := ctxt.ImportDir(d, 0); pkg != nil {
+			queue = append(queue, pkg)
+		}
+	}
+	seen := map[string]bool{}
+	out := []string{}
+	for first := true; len(queue) != 0; first = false {
+		next := []*build.Package{}
+		for _, pkg := range queue {
+			imports := pkg.Imports
+			if first {
+				// Only the tests of the tree are run.
+				imports = append(append(append([]string{}, imports...), pkg.TestImports...), pkg.XTestImports...)
+			}
+			for _, i := range imports {
+				if seen[i] || i == "C" {
+					continue
+				}
+				seen[i] = true
+				dep, err := ctxt.Import(i, pkg.Dir, 0)
+				if err != nil || dep.Goroot {
+					continue
+				}
+				if dep.Dir != root && !strings.HasPrefix(dep.Dir, root+string(filepath.Separator)) {
+					out = append(out, dep.Dir)
+				}
+				next = append(next, dep)
+			}
+		}
+		queue = next
+	}
+	return out
+}
+
+// executableVersion identifies the version of an executable by its size and
+// modification time, which change when it is reinstalled.
+func executableVersion(name string) string {
+	p, err := exec.LookPath(name)
+	if err != nil {
+		return "missing"
+	}
+	stat, err := os.Stat(p)
+	if err != nil {
+		return "missing"
+	}
+	return fmt.Sprintf("%s %d %d", p, stat.Size(), stat.ModTime().UnixNano())
+}
@@ -0,0 +1,194 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package checks
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Change describes the files that were modified and that the checks should
+// look at.
+//
+// A nil *Change means the whole tree is to be checked.
+type Change struct {
+	// Files is the list of modified files, including deleted ones, relative to
+	// the root of the checkout. A file in a testdata directory modifies the
+	// package containing the directory. Other files that are not .go source
+	// files are ignored.
+	Files []string
+
+	lock     sync.Mutex
+	affected map[string]string
+}
+
+// AffectedPackages returns the packages affected by the change, that is the
+// modified packages, all the packages of the tree importing them
+// transitively and the packages whose tests import one of these, mapped to
+// the reason why each was selected.
+func (c *Change) AffectedPackages() map[string]string {
+	out := map[string]string{}
+	for d, reason := range c.affectedDirs() {
+		out[packageName(d)] = reason
+	}
+	return out
+}
+
+// affectedDirs is like AffectedPackages() except that the keys are absolute
+// directories.
+func (c *Change) affectedDirs() map[string]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.affected != nil {
+		return c.affected
+	}
+	isGoDir := map[string]bool{}
+	for _, d := range goDirs(false) {
+		isGoDir[d] = true
+	}
+	for _, d := range goDirs(true) {
+		isGoDir[d] = true
+	}
+	c.affected = map[string]string{}
+	queue := []string{}
+	for d := range c.changedDirs() {
+		if isGoDir[d] {
+			c.affected[d] = "modified"
+			queue = append(queue, d)
+		}
+	}
+	sort.Strings(queue)
+	// Breadth first so that the reason is the shortest import chain.
+	rdeps, testRdeps := reverseImportGraph()
+	affected := []string{}
+	for len(queue) != 0 {
+		d := queue[0]
+		queue = queue[1:]
+		affected = append(affected, d)
+		for _, importer := range rdeps[d] {
+			if _, ok := c.affected[importer]; !ok {
+				c.affected[importer] = "imports " + packageName(d)
+				queue = append(queue, importer)
+			}
+		}
+	}
+	// The tests importing an affected package are affected but the package
+	// they test is not, so its importers are not.
+	for _, d := range affected {
+		for _, importer := range testRdeps[d] {
+			if _, ok := c.affected[importer]; !ok {
+				c.affected[importer] = "tests import " + packageName(d)
+			}
+		}
+	}
+	return c.affected
+}
+
+// goFiles returns the modified .go files that still exist, relative to the
+// root of the checkout.
+func (c *Change) goFiles() []string {
+	out := []string{}
+	for _, f := range c.Files {
+		if !strings.HasSuffix(f, ".go") {
+			continue
+		}
+		p := filepath.FromSlash(f)
+		if _, err := os.Stat(p); err == nil {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// changedDirs returns the set of absolute directories containing modified
+// .go files or testdata directories with modified files.
+func (c *Change) changedDirs() map[string]bool {
+	root, _ := os.Getwd()
+	out := map[string]bool{}
+	for _, f := range c.Files {
+		if d, ok := testdataOwner(f); ok {
+			out[filepath.Join(root, filepath.FromSlash(d))] = true
+		} else if strings.HasSuffix(f, ".go") {
+			out[filepath.Join(root, filepath.Dir(filepath.FromSlash(f)))] = true
+		}
+	}
+	return out
+}
+
+// testdataOwner returns the directory containing the outermost testdata
+// directory f is in, if any. f and the directory are relative to the root of
+// the checkout, with forward slashes.
+func testdataOwner(f string) (string, bool) {
+	parts := strings.Split(f, "/")
+	for i, p := range parts[:len(parts)-1] {
+		if p == "testdata" {
+			return path.Join(parts[:i]...), true
+		}
+	}
+	return "", false
+}
+
+// goDirs is like goDirs() except that it only returns the directories
+// containing modified files.
+func (c *Change) goDirs(tests bool) []string {
+	all := goDirs(tests)
+	if c == nil {
+		return all
+	}
+	changed := c.changedDirs()
+	out := []string{}
+	for _, d := range all {
+		if changed[d] {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// testDirs returns the directories containing tests to run, that is the ones
+// affected by the change.
+func (c *Change) testDirs() []string {
+	all := goDirs(true)
+	if c == nil {
+		return all
+	}
+	affected := c.affectedDirs()
+	out := []string{}
+	for _, d := range all {
+		if _, ok := affected[d]; ok {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// allGoDirs returns all the directories containing .go files, with or
+// without tests, that were modified.
+func (c *Change) allGoDirs() []string {
+	out := []string{}
+	out = append(out, c.goDirs(false)...)
+	out = append(out, c.goDirs(true)...)
+	sort.Strings(out)
+	return out
+}
+
+// relDirs returns the directories as paths relative to the current directory
+// prefixed with "./", as expected by most go tools.
+func relDirs(dirs []string) []string {
+	root, _ := os.Getwd()
+	out := make([]string, 0, len(dirs))
+	for _, d := range dirs {
+		rel, err := filepath.Rel(root, d)
+		if err != nil {
+			rel = d
+		}
+		out = append(out, "."+string(filepath.Separator)+rel)
+	}
+	return out
+}
@@ -10,6 +10,7 @@ package checks
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -20,6 +21,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // CheckPrerequisite describe a Go package that is needed to run a Check.
@@ -46,10 +48,21 @@ type Check interface {
 	// GetPrerequisites lists all the go packages to be installed before running
 	// this check.
 	GetPrerequisites() []CheckPrerequisite
+	// GetDependsOn lists the names of the checks that must pass before this
+	// check is run.
+	GetDependsOn() []string
+	// IsConcurrent returns false if multiple instances of this check, e.g.
+	// configured differently for subtrees, must not run at the same time.
+	IsConcurrent() bool
 	// ResetDefault resets the check to its default values.
 	ResetDefault()
-	// Run executes the check.
-	Run() error
+	// Validate returns a *ConfigError if a value of the check configuration is
+	// invalid.
+	Validate() error
+	// Run executes the check and returns its result. If change is not nil,
+	// the check only looks at the modified files, when it supports it. The
+	// check is aborted when ctx is done.
+	Run(ctx context.Context, change *Change) *Result
 }
 
 // CheckCommon defines the common properties of each check to be serialized in
@@ -62,7 +75,23 @@ type CheckCommon struct {
 	RunLevel int
 	// In seconds. Default to MaxDuration at global scope. The value is omitted
 	// by default since it's likely to be 0 everywhere most of the time.
-	MaxDuration int `yaml:",omitempty";`
+	MaxDuration int `yaml:",omitempty"`
+	// Names of the checks that must pass before this check is run. The check
+	// is skipped if one of them fails. Checks that are not enabled at the
+	// current run level are ignored. Default is none.
+	DependsOn []string `yaml:",omitempty"`
+}
+
+// ConfigError is an invalid value in the configuration of a check.
+type ConfigError struct {
+	// Field is the configuration key of the value, e.g. "minimumcoverage".
+	Field string
+	// Message describes why the value is invalid.
+	Message string
+}
+
+func (c *ConfigError) Error() string {
+	return c.Field + " " + c.Message
 }
 
 func (c *CheckCommon) getRunLevel() int {
@@ -73,6 +102,29 @@ func (c *CheckCommon) getMaxDuration() int {
 	return c.MaxDuration
 }
 
+func (c *CheckCommon) getDependsOn() []string {
+	return c.DependsOn
+}
+
+func (c *CheckCommon) isConcurrent() bool {
+	return true
+}
+
+func (c *CheckCommon) validate() error {
+	if c.RunLevel < 0 || c.RunLevel > 3 {
+		return &ConfigError{"runlevel", fmt.Sprintf("must be between 0 and 3, got %d", c.RunLevel)}
+	}
+	if c.MaxDuration < 0 {
+		return &ConfigError{"maxduration", fmt.Sprintf("must not be negative, got %d", c.MaxDuration)}
+	}
+	for _, d := range c.DependsOn {
+		if d == "" {
+			return &ConfigError{"dependson", "must not list an empty check name"}
+		}
+	}
+	return nil
+}
+
 // check exists to reduce the noise in the doc.
 type check interface {
 	getRunLevel() int
@@ -80,8 +132,11 @@ type check interface {
 	getDescription() string
 	getName() string
 	getPrerequisites() []CheckPrerequisite
+	getDependsOn() []string
+	isConcurrent() bool
 	resetDefault()
-	run() error
+	validate() error
+	run(ctx context.Context, change *Change) error
 }
 
 type checkAdaptor struct {
@@ -103,11 +158,34 @@ func (c checkAdaptor) GetName() string {
 func (c checkAdaptor) GetPrerequisites() []CheckPrerequisite {
 	return c.getPrerequisites()
 }
+func (c checkAdaptor) GetDependsOn() []string {
+	return c.getDependsOn()
+}
+func (c checkAdaptor) IsConcurrent() bool {
+	return c.isConcurrent()
+}
 func (c checkAdaptor) ResetDefault() {
 	c.resetDefault()
 }
-func (c checkAdaptor) Run() error {
-	return c.run()
+func (c checkAdaptor) Validate() error {
+	return c.validate()
+}
+func (c checkAdaptor) Run(ctx context.Context, change *Change) *Result {
+	start := time.Now()
+	tests := &testRecorder{}
+	err := c.run(withTestRecorder(withPriority(ctx, c.getName()), tests), change)
+	r := &Result{Name: c.getName(), Status: Passed, Duration: time.Now().Sub(start), Err: err}
+	r.Tests, r.Packages = tests.sorted()
+	if err != nil {
+		r.Status = Failed
+		if ctx.Err() == context.DeadlineExceeded {
+			r.Status = TimedOut
+		}
+		if f, ok := err.(*Failure); ok {
+			r.Findings = f.Findings
+		}
+	}
+	return r
 }
 
 // Native checks.
@@ -140,13 +218,29 @@ func (b *BuildOnly) getPrerequisites() []CheckPrerequisite {
 	return nil
 }
 
+// isConcurrent returns false since go build leaves files in the tree.
+func (b *BuildOnly) isConcurrent() bool {
+	return false
+}
+
 func (b *BuildOnly) resetDefault() {
 	b.RunLevel = 1
 	b.MaxDuration = 0
+	b.DependsOn = nil
 	b.ExtraArgs = [][]string{{}}
 }
 
-func (b *BuildOnly) run() error {
+func (b *BuildOnly) validate() error {
+	if err := b.CheckCommon.validate(); err != nil {
+		return err
+	}
+	if len(b.ExtraArgs) == 0 {
+		return &ConfigError{"extraargs", "must be at least a list of one empty list"}
+	}
+	return nil
+}
+
+func (b *BuildOnly) run(ctx context.Context, change *Change) error {
 	if len(b.ExtraArgs) == 0 {
 		return fmt.Errorf("ExtraArgs must be at least a list of one empty list")
 	}
@@ -155,13 +249,19 @@ func (b *BuildOnly) run() error {
 	// with -o. On the other hand, ./... and -o foo are incompatible. But
 	// building would have to be done in an efficient way by looking at which
 	// package builds what, to not result in a O(n²) algorithm.
+	pkgs := []string{"./..."}
+	if dirs, ok := scope(ctx); ok {
+		pkgs = relDirs(dirs)
+	}
 	for _, extraarg := range b.ExtraArgs {
 		args := []string{"go", "build"}
 		args = append(args, extraarg...)
-		args = append(args, "./...")
-		out, _, err := capture(args...)
+		args = append(args, pkgs...)
+		out, _, err := capture(ctx, args...)
 		if len(out) != 0 {
-			return fmt.Errorf("%s failed: %s", strings.Join(args, " "), out)
+			findings := parseLocations(out, "", "go build", Error)
+			setRule(findings, "compile-error")
+			return &Failure{Summary: describe(args), Findings: findings, Output: out}
 		}
 		if err != nil {
 			return fmt.Errorf("%s failed: %s", strings.Join(args, " "), err.Error())
@@ -197,22 +297,47 @@ func (g *Gofmt) getPrerequisites() []CheckPrerequisite {
 func (g *Gofmt) resetDefault() {
 	g.RunLevel = 1
 	g.MaxDuration = 0
+	g.DependsOn = nil
 }
 
-func (g *Gofmt) run() error {
+func (g *Gofmt) run(ctx context.Context, change *Change) error {
+	args := []string{"gofmt", "-l", "-s"}
+	if _, ok := scope(ctx); ok && change == nil {
+		// gofmt recurses into the directories, so list the files instead.
+		files := scopeGoFiles(ctx)
+		if len(files) == 0 {
+			return nil
+		}
+		args = append(args, files...)
+	} else if change == nil {
+		args = append(args, ".")
+	} else {
+		files := filesInScope(ctx, change.goFiles())
+		if len(files) == 0 {
+			return nil
+		}
+		args = append(args, files...)
+	}
 	// gofmt doesn't return non-zero even if some files need to be updated.
-	out, _, err := capture("gofmt", "-l", "-s", ".")
+	out, _, err := capture(ctx, args...)
 	if len(out) != 0 {
-		return fmt.Errorf("these files are improperly formmatted, please run: gofmt -w -s .\n%s", out)
+		return &Failure{
+			Summary:  "these files are improperly formmatted, please run: gofmt -w -s .",
+			Findings: parseFileList(out, "gofmt", "file is not formatted with gofmt -s"),
+			Output:   out,
+		}
 	}
 	if err != nil {
-		return fmt.Errorf("gofmt -l -s . failed: %s", err)
+		return fmt.Errorf("%s failed: %s", strings.Join(args, " "), err)
 	}
 	return nil
 }
 
 // Test runs all tests via go test.
 //
+// When only a subset of the tree is checked, the tests of the modified
+// packages and of all the packages importing them, transitively, are run.
+//
 // It is possible to run all tests multiple times, for example if one want to
 // use -tags. Note that TestCoverage is generally a better choice, the main
 // exception is the use of -race.
@@ -221,6 +346,13 @@ type Test struct {
 	// Default is -v -race. Additional arguments to pass, like -race. Can be used
 	// multiple times to run tests multiple times, for example with -tags.
 	ExtraArgs [][]string
+	// Number of times the failed tests are run again before failing the check.
+	// A test passing when retried is reported as flaky. Requires -v to retry
+	// only the failed tests instead of the whole package.
+	Retries int
+	// Tests whose failure is reported but ignored, like "TestFoo" or
+	// "github.com/foo/bar.TestFoo/subtest".
+	Quarantine []string
 }
 
 func (t *Test) Check() Check {
@@ -242,10 +374,26 @@ func (t *Test) getPrerequisites() []CheckPrerequisite {
 func (t *Test) resetDefault() {
 	t.RunLevel = 1
 	t.MaxDuration = 0
+	t.DependsOn = nil
 	t.ExtraArgs = [][]string{{"-v", "-race"}}
+	t.Retries = 0
+	t.Quarantine = []string{}
+}
+
+func (t *Test) validate() error {
+	if err := t.CheckCommon.validate(); err != nil {
+		return err
+	}
+	if len(t.ExtraArgs) == 0 {
+		return &ConfigError{"extraargs", "must be at least a list of one empty list"}
+	}
+	if t.Retries < 0 {
+		return &ConfigError{"retries", fmt.Sprintf("must not be negative, got %d", t.Retries)}
+	}
+	return nil
 }
 
-func (t *Test) run() error {
+func (t *Test) run(ctx context.Context, change *Change) error {
 	if len(t.ExtraArgs) == 0 {
 		return fmt.Errorf("ExtraArgs must be at least a list of one empty list")
 	}
@@ -253,32 +401,38 @@ func (t *Test) run() error {
 	// running all the tests concurrently, which saves a lot of time when there's
 	// many packages.
 	var wg sync.WaitGroup
-	testDirs := goDirs(true)
+	testDirs := inScope(ctx, change.testDirs())
 	for _, extraarg := range t.ExtraArgs {
 		errs := make(chan error, len(testDirs))
 		for _, td := range testDirs {
 			wg.Add(1)
 			go func(testDir string, extraarg []string) {
 				defer wg.Done()
-				rel, err := relToGOPATH(testDir)
+				rel, err := RelToGOPATH(testDir)
 				if err != nil {
 					errs <- err
 					return
 				}
-				args := []string{"go", "test"}
-				args = append(args, extraarg...)
-				args = append(args, rel)
-				out, exitCode, _ := capture(args...)
-				if exitCode != 0 {
-					errs <- fmt.Errorf("%s failed:\n%s", strings.Join(args, " "), out)
+				err = runTests(ctx, rel, relDir(testDir), t.Retries, t.Quarantine, func(extra ...string) (string, []string, int, error) {
+					args := []string{"go", "test"}
+					args = append(args, extraarg...)
+					args = append(args, extra...)
+					args = append(args, rel)
+					out, exitCode, err := capture(ctx, args...)
+					return out, args, exitCode, err
+				})
+				if err != nil {
+					errs <- err
 				}
 			}(td, extraarg)
 		}
 		wg.Wait()
-		select {
-		case err := <-errs:
+		close(errs)
+		if err := joinFailures(drain(errs)); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
 			return err
-		default:
 		}
 	}
 	return nil
@@ -315,24 +469,33 @@ func (e *Errcheck) getPrerequisites() []CheckPrerequisite {
 func (e *Errcheck) resetDefault() {
 	e.RunLevel = 2
 	e.MaxDuration = 0
+	e.DependsOn = nil
 	// "Close|Write.*|Flush|Seek|Read.*"
 	e.Ignores = "Close"
 }
 
-func (e *Errcheck) run() error {
-	dirs := goDirs(false)
+func (e *Errcheck) run(ctx context.Context, change *Change) error {
+	dirs := inScope(ctx, change.goDirs(false))
+	if len(dirs) == 0 {
+		return nil
+	}
 	args := make([]string, 0, len(dirs)+2)
 	args = append(args, "errcheck", "-ignore", e.Ignores)
 	for _, d := range dirs {
-		rel, err := relToGOPATH(d)
+		rel, err := RelToGOPATH(d)
 		if err != nil {
 			return err
 		}
 		args = append(args, rel)
 	}
-	out, _, err := capture(args...)
+	out, _, err := capture(ctx, args...)
 	if len(out) != 0 {
-		return fmt.Errorf("%s failed:\n%s", strings.Join(args, " "), out)
+		findings := parseLocations(out, "", "errcheck", Error)
+		for i := range findings {
+			findings[i].Message = "unchecked error: " + findings[i].Message
+		}
+		setRule(findings, "unchecked-error")
+		return &Failure{Summary: describe(args), Findings: findings, Output: out}
 	}
 	if err != nil {
 		return fmt.Errorf("%s failed: %s", strings.Join(args, " "), err)
@@ -366,24 +529,46 @@ func (g *Goimports) getPrerequisites() []CheckPrerequisite {
 func (g *Goimports) resetDefault() {
 	g.RunLevel = 2
 	g.MaxDuration = 0
+	g.DependsOn = nil
 }
 
-func (g *Goimports) run() error {
+func (g *Goimports) run(ctx context.Context, change *Change) error {
+	args := []string{"goimports", "-l"}
+	if _, ok := scope(ctx); ok && change == nil {
+		// goimports recurses into the directories, so list the files instead.
+		files := scopeGoFiles(ctx)
+		if len(files) == 0 {
+			return nil
+		}
+		args = append(args, files...)
+	} else if change == nil {
+		args = append(args, ".")
+	} else {
+		files := filesInScope(ctx, change.goFiles())
+		if len(files) == 0 {
+			return nil
+		}
+		args = append(args, files...)
+	}
 	// goimports doesn't return non-zero even if some files need to be updated.
-	out, _, err := capture("goimports", "-l", ".")
+	out, _, err := capture(ctx, args...)
 	if len(out) != 0 {
-		return fmt.Errorf("these files are improperly formmatted, please run: goimports -w .\n%s", out)
+		return &Failure{
+			Summary:  "these files are improperly formmatted, please run: goimports -w .",
+			Findings: parseFileList(out, "goimports", "file is not formatted with goimports"),
+			Output:   out,
+		}
 	}
 	if err != nil {
-		return fmt.Errorf("goimports -w . failed: %s", err)
+		return fmt.Errorf("%s failed: %s", strings.Join(args, " "), err)
 	}
 	return nil
 }
 
 // Golint runs golint.
 //
-// golint triggers false positives by design. Use Blacklist to ignore
-// messages wholesale.
+// The check fails when golint reports anything. golint triggers false
+// positives by design. Use Blacklist to ignore messages wholesale.
 type Golint struct {
 	CheckCommon `yaml:",inline"`
 	// Messages generated by golint to be ignored.
@@ -411,31 +596,40 @@ func (g *Golint) getPrerequisites() []CheckPrerequisite {
 func (g *Golint) resetDefault() {
 	g.RunLevel = 3
 	g.MaxDuration = 0
+	g.DependsOn = nil
 	g.Blacklist = []string{}
 }
 
-func (g *Golint) run() error {
-	// golint doesn't return non-zero ever.
-	out, _, _ := capture("golint", "./...")
-	result := []string{}
-	for _, line := range strings.Split(string(out), "\n") {
-		for _, b := range g.Blacklist {
-			if strings.Contains(line, b) {
-				continue
-			}
+func (g *Golint) run(ctx context.Context, change *Change) error {
+	args := []string{"golint"}
+	if dirs, ok := scope(ctx); ok && change == nil {
+		args = append(args, relDirs(dirs)...)
+	} else if change == nil {
+		args = append(args, "./...")
+	} else {
+		dirs := inScope(ctx, change.allGoDirs())
+		if len(dirs) == 0 {
+			return nil
 		}
-		result = append(result, line)
+		args = append(args, relDirs(dirs)...)
 	}
-	if len(result) == 0 {
-		return errors.New(strings.Join(result, "\n"))
+	// golint doesn't return non-zero ever.
+	out, _, err := capture(ctx, args...)
+	if err != nil {
+		return fmt.Errorf("%s failed: %s", strings.Join(args, " "), err)
+	}
+	findings := filterBlacklist(parseLocations(out, "", "golint", Warning), g.Blacklist)
+	classify(findings, golintRules)
+	if len(findings) != 0 {
+		return &Failure{Summary: describe(args), Findings: findings}
 	}
 	return nil
 }
 
 // Govet runs "go tool vet".
 //
-// govet triggers false positives by design. Use Blacklist to ignore
-// messages wholesale.
+// The check fails when go tool vet reports anything. govet triggers false
+// positives by design. Use Blacklist to ignore messages wholesale.
 type Govet struct {
 	CheckCommon `yaml:",inline"`
 	// Messages generated by go tool vet to be ignored.
@@ -463,23 +657,32 @@ func (g *Govet) getPrerequisites() []CheckPrerequisite {
 func (g *Govet) resetDefault() {
 	g.RunLevel = 3
 	g.MaxDuration = 0
+	g.DependsOn = nil
 	g.Blacklist = []string{" composite literal uses unkeyed fields"}
 }
 
-func (g *Govet) run() error {
-	// Ignore the return code since we ignore many errors.
-	out, _, _ := capture("go", "tool", "vet", "-all", ".")
-	result := []string{}
-	for _, line := range strings.Split(string(out), "\n") {
-		for _, b := range g.Blacklist {
-			if strings.Contains(line, b) {
-				continue
-			}
+func (g *Govet) run(ctx context.Context, change *Change) error {
+	args := []string{"go", "tool", "vet", "-all"}
+	if dirs, ok := scope(ctx); ok && change == nil {
+		args = append(args, relDirs(dirs)...)
+	} else if change == nil {
+		args = append(args, ".")
+	} else {
+		dirs := inScope(ctx, change.allGoDirs())
+		if len(dirs) == 0 {
+			return nil
 		}
-		result = append(result, line)
+		args = append(args, relDirs(dirs)...)
 	}
-	if len(result) == 0 {
-		return errors.New(strings.Join(result, "\n"))
+	// Ignore the return code since we ignore many errors.
+	out, _, err := capture(ctx, args...)
+	if err != nil {
+		return fmt.Errorf("%s failed: %s", strings.Join(args, " "), err)
+	}
+	findings := filterBlacklist(parseLocations(out, "", "govet", Warning), g.Blacklist)
+	classify(findings, govetRules)
+	if len(findings) != 0 {
+		return &Failure{Summary: describe(args), Findings: findings}
 	}
 	return nil
 }
@@ -499,6 +702,11 @@ type TestCoverage struct {
 	CheckCommon `yaml:",inline"`
 	// Minimum test coverage to be generated or the check is considered to fail.
 	MinimumCoverage float64
+	// Number of times the failed tests are run again before failing the check,
+	// like Test.Retries. The coverage is not measured when retrying.
+	Retries int
+	// Tests whose failure is reported but ignored, like Test.Quarantine.
+	Quarantine []string
 }
 
 func (t *TestCoverage) Check() Check {
@@ -526,19 +734,49 @@ func (t *TestCoverage) getPrerequisites() []CheckPrerequisite {
 func (t *TestCoverage) resetDefault() {
 	t.RunLevel = 2
 	t.MaxDuration = 0
+	t.DependsOn = nil
 	t.MinimumCoverage = 20.
+	t.Retries = 0
+	t.Quarantine = []string{}
 }
 
-func (t *TestCoverage) run() (err error) {
+func (t *TestCoverage) validate() error {
+	if err := t.CheckCommon.validate(); err != nil {
+		return err
+	}
+	if t.MinimumCoverage < 0 || t.MinimumCoverage > 100 {
+		return &ConfigError{"minimumcoverage", fmt.Sprintf("must be between 0 and 100, got %g", t.MinimumCoverage)}
+	}
+	if t.Retries < 0 {
+		return &ConfigError{"retries", fmt.Sprintf("must not be negative, got %d", t.Retries)}
+	}
+	return nil
+}
+
+func (t *TestCoverage) run(ctx context.Context, change *Change) (err error) {
 	pkgRoot, _ := os.Getwd()
-	pkg, err2 := relToGOPATH(pkgRoot)
+	pkg, err2 := RelToGOPATH(pkgRoot)
 	if err2 != nil {
 		return err2
 	}
-	testDirs := goDirs(true)
+	testDirs := inScope(ctx, goDirs(true))
 	if len(testDirs) == 0 {
 		return nil
 	}
+	// Only the packages in scope are measured, so that the coverage of a
+	// subtree is not diluted by the rest of the tree.
+	coverPkg := pkg + "/..."
+	if dirs, ok := scope(ctx); ok {
+		pkgs := make([]string, 0, len(dirs))
+		for _, d := range dirs {
+			rel, err2 := RelToGOPATH(d)
+			if err2 != nil {
+				return err2
+			}
+			pkgs = append(pkgs, rel)
+		}
+		coverPkg = strings.Join(pkgs, ",")
+	}
 
 	tmpDir, err2 := ioutil.TempDir("", "pre-commit-go")
 	if err2 != nil {
@@ -560,17 +798,31 @@ func (t *TestCoverage) run() (err error) {
 		wg.Add(1)
 		go func(index int, testDir string) {
 			defer wg.Done()
-			args := []string{
-				"go", "test", "-v", "-covermode=count", "-coverpkg", pkg + "/...",
-				"-coverprofile", filepath.Join(tmpDir, fmt.Sprintf("test%d.cov", index)),
-			}
-			out, exitCode, _ := captureWd(testDir, args...)
-			if exitCode != 0 {
-				errs <- fmt.Errorf("%s %s failed:\n%s", strings.Join(args, " "), testDir, out)
+			rel, _ := RelToGOPATH(testDir)
+			err := runTests(ctx, rel, relDir(testDir), t.Retries, t.Quarantine, func(extra ...string) (string, []string, int, error) {
+				args := []string{"go", "test", "-v"}
+				if extra == nil {
+					args = append(args, "-covermode=count", "-coverpkg", coverPkg, "-coverprofile", filepath.Join(tmpDir, fmt.Sprintf("test%d.cov", index)))
+				}
+				args = append(args, extra...)
+				out, exitCode, err := captureWd(ctx, testDir, args...)
+				return out, append(args, testDir), exitCode, err
+			})
+			if err != nil {
+				errs <- err
 			}
 		}(i, td)
 	}
 	wg.Wait()
+	close(errs)
+	testErr := joinFailures(drain(errs))
+	if err2 := ctx.Err(); err2 != nil {
+		// Report the partial output of the tests that were killed, if any.
+		if testErr != nil {
+			return testErr
+		}
+		return err2
+	}
 
 	// Merge the profiles. Sums all the counts.
 	// Format is "file.go:XX.YY,ZZ.II J K"
@@ -580,12 +832,10 @@ func (t *TestCoverage) run() (err error) {
 		return err2
 	}
 	if len(files) == 0 {
-		select {
-		case err2 := <-errs:
-			return err2
-		default:
-			return errors.New("no coverage found")
+		if testErr != nil {
+			return testErr
 		}
+		return errors.New("no coverage found")
 	}
 	counts := map[string]int{}
 	for _, file := range files {
@@ -627,23 +877,20 @@ func (t *TestCoverage) run() (err error) {
 	f.Close()
 
 	// Analyze the results.
-	out, _, err2 := capture("go", "tool", "cover", "-func", profilePath)
+	out, _, err2 := capture(ctx, "go", "tool", "cover", "-func", profilePath)
 	type fn struct {
 		loc  string
 		name string
 	}
 	coverage := map[fn]float64{}
 	var total float64
-	for i, line := range strings.Split(out, "\n") {
-		if i == 0 || len(line) == 0 {
-			// First or last line.
-			continue
-		}
+	for _, line := range strings.Split(out, "\n") {
 		items := strings.SplitN(line, "\t", 2)
-		loc := items[0]
 		if len(items) == 1 {
-			panic(fmt.Sprintf("%#v %#v", line, items))
+			// Empty line, e.g. the trailing one.
+			continue
 		}
+		loc := items[0]
 		items = strings.SplitN(strings.TrimLeft(items[1], "\t"), "\t", 2)
 		name := items[0]
 		percentStr := strings.TrimLeft(items[1], "\t")
@@ -658,25 +905,31 @@ func (t *TestCoverage) run() (err error) {
 		}
 	}
 	if total < t.MinimumCoverage {
-		partial := 0
-		for _, percent := range coverage {
+		findings := []Finding{}
+		for f, percent := range coverage {
 			if percent < 100. {
-				partial++
+				// The location is like "github.com/foo/bar/baz.go:12:".
+				if finding, ok := parseLocation(strings.TrimPrefix(f.loc, pkg+"/"), "", "testcoverage", Warning); ok {
+					finding.Message = fmt.Sprintf("%s is %3.1f%% covered", f.name, percent)
+					finding.Rule = "low-coverage"
+					findings = append(findings, finding)
+				}
 			}
 		}
-		err2 = fmt.Errorf("code coverage: %3.1f%%; %d untested functions", total, partial)
+		sort.Sort(findingsByLocation(findings))
+		err2 = &Failure{
+			Summary:  fmt.Sprintf("code coverage: %3.1f%%; %d untested functions", total, len(findings)),
+			Findings: findings,
+		}
 	}
 	if err2 == nil {
-		select {
-		case err2 = <-errs:
-		default:
-		}
+		err2 = testErr
 	}
 
 	// Sends to coveralls.io if applicable.
 	if len(os.Getenv("TRAVIS_JOB_ID")) != 0 {
 		// Make sure to have registered to https://coveralls.io first!
-		out, _, err3 := capture("goveralls", "-coverprofile", profilePath)
+		out, _, err3 := capture(ctx, "goveralls", "-coverprofile", profilePath)
 		fmt.Printf("%s", out)
 		if err2 == nil {
 			err2 = err3
@@ -688,6 +941,11 @@ func (t *TestCoverage) run() (err error) {
 // Extensibility.
 
 // CustomCheck represents a user configured check.
+//
+// The command is run from the root of the tree with the environment variable
+// PRE_COMMIT_GO_DIRS set to the directories of the packages to check,
+// separated by spaces, like "./foo ./bar". It is "./..." when the check
+// applies to the whole tree.
 type CustomCheck struct {
 	CheckCommon `yaml:",inline"`
 	// Check's display name, required.
@@ -723,10 +981,34 @@ func (c *CustomCheck) resetDefault() {
 	// There's no default for a custom check.
 }
 
-func (c *CustomCheck) run() error {
-	out, exitCode, err := capture(c.Command...)
+func (c *CustomCheck) validate() error {
+	if c.Name == "" {
+		return &ConfigError{"name", "is required"}
+	}
+	if err := c.CheckCommon.validate(); err != nil {
+		return err
+	}
+	if len(c.Command) == 0 || c.Command[0] == "" {
+		return &ConfigError{"command", "is required"}
+	}
+	return nil
+}
+
+func (c *CustomCheck) run(ctx context.Context, change *Change) error {
+	dirs := []string{"./..."}
+	if s, ok := scope(ctx); ok {
+		if len(s) == 0 {
+			return nil
+		}
+		dirs = relDirs(s)
+	}
+	out, exitCode, err := captureEnv(ctx, "", []string{"PRE_COMMIT_GO_DIRS=" + strings.Join(dirs, " ")}, c.Command...)
 	if exitCode != 0 && c.CheckExitCode {
-		return fmt.Errorf("%d failed:\n%s", strings.Join(c.Command, " "), out)
+		// Custom tools usually print locations like the Go tools do.
+		return &Failure{Summary: describe(c.Command), Findings: parseLocations(out, "", c.Name, Error), Output: out}
 	}
-	return err
+	if err != nil {
+		return fmt.Errorf("%s failed: %s\n%s", strings.Join(c.Command, " "), err, out)
+	}
+	return nil
 }
@@ -0,0 +1,61 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package checks
+
+import (
+	"go/build"
+	"log"
+)
+
+// reverseImportGraph returns, for each directory containing a package of the
+// tree, the directories of the packages of the tree that import it, and
+// separately the ones that only import it from their tests.
+//
+// Imports of packages outside the tree are ignored.
+func reverseImportGraph() (imports, testImports map[string][]string) {
+	dirs := []string{}
+	dirs = append(dirs, goDirs(false)...)
+	dirs = append(dirs, goDirs(true)...)
+	byImportPath := make(map[string]string, len(dirs))
+	for _, d := range dirs {
+		if rel, err := RelToGOPATH(d); err == nil {
+			byImportPath[rel] = d
+		}
+	}
+	imports = map[string][]string{}
+	testImports = map[string][]string{}
+	for _, d := range dirs {
+		pkg, err := build.ImportDir(d, 0)
+		if pkg == nil {
+			log.Printf("failed to parse %s: %s", d, err)
+			continue
+		}
+		seen := map[string]bool{}
+		for i, list := range [][]string{pkg.Imports, pkg.TestImports, pkg.XTestImports} {
+			for _, p := range list {
+				dep, ok := byImportPath[p]
+				if !ok || dep == d || seen[dep] {
+					continue
+				}
+				seen[dep] = true
+				if i == 0 {
+					imports[dep] = append(imports[dep], d)
+				} else {
+					testImports[dep] = append(testImports[dep], d)
+				}
+			}
+		}
+	}
+	return imports, testImports
+}
+
+// packageName returns the import path of the package in directory d, or its
+// relative path if it is not inside GOPATH.
+func packageName(d string) string {
+	if rel, err := RelToGOPATH(d); err == nil {
+		return rel
+	}
+	return relDirs([]string{d})[0]
+}
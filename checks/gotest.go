@@ -0,0 +1,386 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package checks
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TestCase is the result of one Go test, parsed from the output of
+// 'go test -v'.
+type TestCase struct {
+	// Package is the import path of the package of the test.
+	Package string
+	// Name is the test name, e.g. "TestFoo" or "TestFoo/subtest".
+	Name string
+	// Status is Passed, Failed or Skipped.
+	Status Status
+	// Duration is the run time reported by go test.
+	Duration time.Duration
+	// Output is what the test logged. For a flaky test, it is the output of
+	// the attempt that failed.
+	Output string
+	// Flaky is true if the test failed then passed when retried.
+	Flaky bool
+	// Quarantined is true if the test failed but is listed in the quarantine
+	// of the check, so its failure was ignored.
+	Quarantined bool
+}
+
+// PackageTiming is how long the tests of a package took.
+type PackageTiming struct {
+	// Package is the import path of the package.
+	Package string
+	// Duration is the run time reported by go test, which excludes the
+	// compilation.
+	Duration time.Duration
+}
+
+// testRecorder collects the tests run by a check.
+type testRecorder struct {
+	lock     sync.Mutex
+	tests    []TestCase
+	packages []PackageTiming
+}
+
+type testRecorderKey struct{}
+
+// withTestRecorder returns a context for a check recording its tests into r.
+func withTestRecorder(ctx context.Context, r *testRecorder) context.Context {
+	return context.WithValue(ctx, testRecorderKey{}, r)
+}
+
+// recordTests adds the tests run by a check on package pkg to the recorder in
+// ctx, if any, along with how long they took according to out, the output of
+// go test.
+func recordTests(ctx context.Context, pkg, out string, tests []TestCase) {
+	if r, ok := ctx.Value(testRecorderKey{}).(*testRecorder); ok {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.tests = append(r.tests, tests...)
+		if d, ok := parsePackageDuration(out, pkg); ok {
+			r.packages = append(r.packages, PackageTiming{pkg, d})
+		}
+	}
+}
+
+// sorted returns the recorded tests and package timings, grouped by package.
+// The packages are tested concurrently, so they are recorded in random order.
+func (r *testRecorder) sorted() ([]TestCase, []PackageTiming) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sort.Stable(testsByPackage(r.tests))
+	sort.Sort(timingsByPackage(r.packages))
+	return r.tests, r.packages
+}
+
+type timingsByPackage []PackageTiming
+
+func (t timingsByPackage) Len() int           { return len(t) }
+func (t timingsByPackage) Less(i, j int) bool { return t[i].Package < t[j].Package }
+func (t timingsByPackage) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+type testsByPackage []TestCase
+
+func (t testsByPackage) Len() int           { return len(t) }
+func (t testsByPackage) Less(i, j int) bool { return t[i].Package < t[j].Package }
+func (t testsByPackage) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// testStatusRe matches the lines go test prints when a test starts and ends,
+// e.g. "--- FAIL: TestFoo (0.12s)".
+var testStatusRe = regexp.MustCompile(`^\s*(=== RUN|=== PAUSE|=== CONT|=== NAME|--- FAIL:|--- PASS:|--- SKIP:)\s+(\S+)(?:\s+\(([0-9.]+)s\))?`)
+
+// testEndRe matches the lines go test prints once all the tests of a package
+// ran.
+var testEndRe = regexp.MustCompile(`^(PASS|FAIL|ok\s|FAIL\s|exit status \d+)`)
+
+// parsePackageDuration returns the run time of the tests of package pkg from
+// the last line go test prints, e.g. "ok  	foo/bar	0.123s". It returns false
+// if the result was cached by go test.
+func parsePackageDuration(out, pkg string) (time.Duration, bool) {
+	for _, line := range strings.Split(out, "\n") {
+		items := strings.Split(strings.TrimSpace(line), "\t")
+		if len(items) < 3 || (strings.TrimSpace(items[0]) != "ok" && strings.TrimSpace(items[0]) != "FAIL") || items[1] != pkg {
+			continue
+		}
+		// The duration is followed by the coverage, if any.
+		fields := strings.Fields(items[2])
+		if len(fields) == 0 {
+			continue
+		}
+		if secs, err := strconv.ParseFloat(strings.TrimSuffix(fields[0], "s"), 64); err == nil {
+			return time.Duration(secs * float64(time.Second)), true
+		}
+	}
+	return 0, false
+}
+
+// parseGoTest parses the output of go test for package pkg, run in directory
+// dir relative to the root of the checkout.
+//
+// It returns the tests that ran, which are only known with -v, and a finding
+// for each located message of the failed tests and for each build error. The
+// messages logged by the tests that passed are ignored.
+func parseGoTest(out, pkg, dir string) ([]TestCase, []Finding) {
+	tests := []TestCase{}
+	index := map[string]int{}
+	ended := map[string]bool{}
+	logs := map[string][]string{}
+	located := map[string][]Finding{}
+	failed := []string{}
+	current := ""
+	for _, line := range strings.Split(out, "\n") {
+		if m := testStatusRe.FindStringSubmatch(line); m != nil {
+			current = m[2]
+			i, ok := index[current]
+			if !ok {
+				i = len(tests)
+				index[current] = i
+				tests = append(tests, TestCase{Package: pkg, Name: current, Status: Passed})
+			}
+			if strings.HasPrefix(m[1], "---") {
+				ended[current] = true
+			}
+			switch m[1] {
+			case "--- FAIL:":
+				tests[i].Status = Failed
+				failed = append(failed, current)
+			case "--- SKIP:":
+				tests[i].Status = Skipped
+			}
+			if secs, err := strconv.ParseFloat(m[3], 64); err == nil {
+				tests[i].Duration = time.Duration(secs * float64(time.Second))
+			}
+			continue
+		}
+		if testEndRe.MatchString(line) {
+			current = ""
+			continue
+		}
+		if current != "" {
+			logs[current] = append(logs[current], line)
+		}
+		if f, ok := parseLocation(line, dir, "go test", Error); ok {
+			f.Rule = "test-failure"
+			if current == "" {
+				f.Rule = "compile-error"
+			} else {
+				f.Message = current + ": " + f.Message
+			}
+			located[current] = append(located[current], f)
+		} else if strings.HasPrefix(line, "panic: ") {
+			located[current] = append(located[current], Finding{Severity: Error, Message: line, Tool: "go test", Rule: "panic"})
+		}
+	}
+	for i := range tests {
+		if !ended[tests[i].Name] {
+			// The test never completed, e.g. another test panicked or the
+			// package was killed.
+			tests[i].Status = Failed
+		}
+		tests[i].Output = strings.TrimRight(strings.Join(logs[tests[i].Name], "\n"), "\n")
+	}
+	findings := located[""]
+	for _, name := range failed {
+		if len(located[name]) == 0 && !hasFailedSubtest(failed, name) {
+			findings = append(findings, Finding{Severity: Error, Message: name + " failed", Tool: "go test", Rule: "test-failure"})
+		}
+		findings = append(findings, located[name]...)
+		delete(located, name)
+	}
+	return tests, findings
+}
+
+// hasFailedSubtest returns true if one of the failed tests is a subtest of
+// test name, which is then failing only because of it.
+func hasFailedSubtest(failed []string, name string) bool {
+	for _, f := range failed {
+		if strings.HasPrefix(f, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// runTests runs the tests of package pkg, in directory dir relative to the
+// root of the checkout, and records them.
+//
+// run runs go test with extra arguments appended, returning its output, the
+// command line, the exit code and the error of captureWd(). The failed tests
+// are retried up to retries times, each time only running the tests that
+// failed, or the whole package if the tests are not known because go test was
+// not run with -v. A test passing when retried is flaky. The failures of the tests matching
+// quarantine are ignored.
+//
+// It returns a *Failure if a test still fails or go test failed for another
+// reason, e.g. a build error. A package that was cancelled without printing
+// anything, usually because it was still waiting for a job slot, is not a
+// failure; an error telling so is returned instead.
+func runTests(ctx context.Context, pkg, dir string, retries int, quarantine []string, run func(extra ...string) (string, []string, int, error)) error {
+	out, args, exitCode, err := run()
+	if err != nil && ctx.Err() != nil && out == "" {
+		return fmt.Errorf("go test %s was cancelled: %s", pkg, err)
+	}
+	tests, findings := parseGoTest(out, pkg, dir)
+	for attempt := 0; exitCode != 0 && attempt < retries && ctx.Err() == nil; attempt++ {
+		var extra []string
+		if len(tests) != 0 {
+			failing := failedTests(tests)
+			if len(failing) == 0 {
+				// go test failed for another reason, like a build error.
+				break
+			}
+			extra = []string{"-run", "^(" + strings.Join(failing, "|") + ")$"}
+		}
+		// Do not use a result cached by go test, it would hide flakiness.
+		extra = append([]string{"-count=1"}, extra...)
+		retryOut, retryArgs, retryExitCode, err := run(extra...)
+		if err != nil && ctx.Err() != nil && retryOut == "" {
+			// Cancelled before the retry printed anything, keep the result of
+			// the previous attempt.
+			break
+		}
+		out, args, exitCode = retryOut, retryArgs, retryExitCode
+		var retried []TestCase
+		retried, findings = parseGoTest(out, pkg, dir)
+		mergeRetry(tests, retried)
+	}
+	// Record the tests once they are marked as quarantined.
+	defer func() {
+		recordTests(ctx, pkg, out, tests)
+	}()
+	if exitCode == 0 {
+		return nil
+	}
+	if len(quarantine) != 0 {
+		ignored, all := markQuarantined(tests, quarantine)
+		remaining := []Finding{}
+		for _, f := range findings {
+			if !isAbout(f, ignored) {
+				remaining = append(remaining, f)
+			}
+		}
+		if all && len(ignored) != 0 && len(remaining) == 0 {
+			return nil
+		}
+		findings = remaining
+	}
+	return &Failure{Summary: describe(args), Findings: findings, Output: out}
+}
+
+// failedTests returns the top level tests that failed, as regexp to be passed
+// to go test -run.
+func failedTests(tests []TestCase) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, t := range tests {
+		if t.Status != Failed {
+			continue
+		}
+		name := strings.SplitN(t.Name, "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, regexp.QuoteMeta(name))
+		}
+	}
+	return out
+}
+
+// mergeRetry updates tests with the result of retrying the tests that failed.
+// A failed test that passed when retried is marked flaky; it keeps the output
+// of its failure.
+func mergeRetry(tests, retried []TestCase) {
+	index := map[string]int{}
+	for i, t := range tests {
+		index[t.Name] = i
+	}
+	for _, r := range retried {
+		i, ok := index[r.Name]
+		if !ok || tests[i].Status != Failed {
+			continue
+		}
+		if r.Status == Passed {
+			tests[i].Status = Passed
+			tests[i].Flaky = true
+			tests[i].Duration = r.Duration
+		} else {
+			tests[i] = r
+		}
+	}
+}
+
+// markQuarantined marks the failed tests covered by the quarantine and returns
+// their names, and whether all the failed tests are covered.
+//
+// A test is covered if it, or one of its parents, is listed either by name,
+// e.g. "TestFoo", or by package and name, e.g. "github.com/foo/bar.TestFoo". A
+// test failing only because of its subtests is covered if all of them are.
+func markQuarantined(tests []TestCase, quarantine []string) (map[string]bool, bool) {
+	failed := []string{}
+	for _, t := range tests {
+		if t.Status == Failed {
+			failed = append(failed, t.Name)
+		}
+	}
+	ignored := map[string]bool{}
+	all := true
+	for i, t := range tests {
+		if t.Status != Failed {
+			continue
+		}
+		covered := inQuarantine(t, quarantine)
+		if !covered && hasFailedSubtest(failed, t.Name) {
+			covered = true
+			for _, f := range failed {
+				if strings.HasPrefix(f, t.Name+"/") && !hasFailedSubtest(failed, f) && !inQuarantine(TestCase{Package: t.Package, Name: f}, quarantine) {
+					covered = false
+				}
+			}
+		}
+		if covered {
+			tests[i].Quarantined = true
+			ignored[t.Name] = true
+		} else {
+			all = false
+		}
+	}
+	return ignored, all
+}
+
+// inQuarantine returns true if the test t or one of its parents is listed in
+// quarantine.
+func inQuarantine(t TestCase, quarantine []string) bool {
+	for name := t.Name; name != ""; {
+		for _, q := range quarantine {
+			if q == name || q == t.Package+"."+name {
+				return true
+			}
+		}
+		i := strings.LastIndex(name, "/")
+		if i == -1 {
+			break
+		}
+		name = name[:i]
+	}
+	return false
+}
+
+// isAbout returns true if the finding f, as returned by parseGoTest, is about
+// one of the tests.
+func isAbout(f Finding, tests map[string]bool) bool {
+	for name := range tests {
+		if f.Message == fmt.Sprintf("%s failed", name) || strings.HasPrefix(f.Message, name+": ") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package checks
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	passA   = "=== RUN   TestA\n--- PASS: TestA (0.01s)\n"
+	failB   = "=== RUN   TestB\n    b_test.go:10: boom\n--- FAIL: TestB (0.02s)\n"
+	passB   = "=== RUN   TestB\n--- PASS: TestB (0.03s)\n"
+	failC   = "=== RUN   TestC\n=== RUN   TestC/sub\n    c_test.go:5: bad\n--- FAIL: TestC (0.00s)\n    --- FAIL: TestC/sub (0.00s)\n"
+	okEnd   = "PASS\nok  \tfoo/bar\t0.050s\n"
+	failEnd = "FAIL\nFAIL\tfoo/bar\t0.050s\n"
+)
+
+func TestParseGoTest(t *testing.T) {
+	data := []struct {
+		out      string
+		tests    []TestCase
+		findings []Finding
+	}{
+		{
+			passA + okEnd,
+			[]TestCase{{Package: "foo/bar", Name: "TestA", Status: Passed, Duration: 10 * time.Millisecond}},
+			nil,
+		},
+		{
+			passA + failB + failEnd,
+			[]TestCase{
+				{Package: "foo/bar", Name: "TestA", Status: Passed, Duration: 10 * time.Millisecond},
+				{Package: "foo/bar", Name: "TestB", Status: Failed, Duration: 20 * time.Millisecond, Output: "    b_test.go:10: boom"},
+			},
+			// b_test.go is not in bar, so it is assumed to be at the root.
+			[]Finding{{File: "b_test.go", Line: 10, Severity: Error, Message: "TestB: boom", Tool: "go test", Rule: "test-failure"}},
+		},
+		{
+			// A test never completed, e.g. the package was killed.
+			"=== RUN   TestD\n",
+			[]TestCase{{Package: "foo/bar", Name: "TestD", Status: Failed}},
+			nil,
+		},
+	}
+	for i, line := range data {
+		tests, findings := parseGoTest(line.out, "foo/bar", "bar")
+		if !reflect.DeepEqual(tests, line.tests) {
+			t.Errorf("#%d: tests\n got %#v\nwant %#v", i, tests, line.tests)
+		}
+		if len(findings) == 0 {
+			findings = nil
+		}
+		if !reflect.DeepEqual(findings, line.findings) {
+			t.Errorf("#%d: findings\n got %#v\nwant %#v", i, findings, line.findings)
+		}
+	}
+}
+
+func TestMarkQuarantined(t *testing.T) {
+	data := []struct {
+		failed     []string
+		quarantine []string
+		ignored    map[string]bool
+		all        bool
+	}{
+		{[]string{"TestB"}, []string{"TestB"}, map[string]bool{"TestB": true}, true},
+		{[]string{"TestB"}, []string{"foo/bar.TestB"}, map[string]bool{"TestB": true}, true},
+		{[]string{"TestB"}, []string{"other/pkg.TestB"}, map[string]bool{}, false},
+		{[]string{"TestB", "TestC"}, []string{"TestB"}, map[string]bool{"TestB": true}, false},
+		// A test failing only because of its quarantined subtest is covered.
+		{[]string{"TestC", "TestC/sub"}, []string{"TestC/sub"}, map[string]bool{"TestC": true, "TestC/sub": true}, true},
+		// A quarantined parent covers its subtests.
+		{[]string{"TestC", "TestC/sub"}, []string{"TestC"}, map[string]bool{"TestC": true, "TestC/sub": true}, true},
+	}
+	for i, line := range data {
+		tests := []TestCase{{Package: "foo/bar", Name: "TestA", Status: Passed}}
+		for _, name := range line.failed {
+			tests = append(tests, TestCase{Package: "foo/bar", Name: name, Status: Failed})
+		}
+		ignored, all := markQuarantined(tests, line.quarantine)
+		if !reflect.DeepEqual(ignored, line.ignored) || all != line.all {
+			t.Errorf("#%d: got %v, %t; want %v, %t", i, ignored, all, line.ignored, line.all)
+		}
+		for _, test := range tests {
+			if test.Quarantined != line.ignored[test.Name] {
+				t.Errorf("#%d: %s: Quarantined is %t", i, test.Name, test.Quarantined)
+			}
+		}
+	}
+}
+
+func TestRunTests(t *testing.T) {
+	type attempt struct {
+		out      string
+		exitCode int
+	}
+	data := []struct {
+		name       string
+		attempts   []attempt
+		retries    int
+		quarantine []string
+		// fail is true if runTests must return an error.
+		fail bool
+		// runs is the number of times go test is expected to run.
+		runs        int
+		flaky       []string
+		quarantined []string
+	}{
+		{"pass", []attempt{{passA + okEnd, 0}}, 2, nil, false, 1, nil, nil},
+		{"failure", []attempt{{passA + failB + failEnd, 1}}, 0, nil, true, 1, nil, nil},
+		{"retry success", []attempt{{passA + failB + failEnd, 1}, {passB + okEnd, 0}}, 2, nil, false, 2, []string{"TestB"}, nil},
+		{"retry failure", []attempt{{passA + failB + failEnd, 1}, {failB + failEnd, 1}, {failB + failEnd, 1}}, 2, nil, true, 3, nil, nil},
+		{"quarantined", []attempt{{passA + failB + failEnd, 1}}, 0, []string{"TestB"}, false, 1, nil, []string{"TestB"}},
+		{"quarantined subtest", []attempt{{passA + failC + failEnd, 1}}, 0, []string{"TestC/sub"}, false, 1, nil, []string{"TestC", "TestC/sub"}},
+		{"not quarantined", []attempt{{passA + failB + failC + failEnd, 1}}, 0, []string{"TestB"}, true, 1, nil, []string{"TestB"}},
+		{"build error", []attempt{{"b.go:3: undefined: x\nFAIL\tfoo/bar [build failed]\n", 2}}, 0, []string{"TestB"}, true, 1, nil, nil},
+	}
+	for _, line := range data {
+		runs := 0
+		r := &testRecorder{}
+		ctx := withTestRecorder(context.Background(), r)
+		err := runTests(ctx, "foo/bar", "bar", line.retries, line.quarantine, func(extra ...string) (string, []string, int, error) {
+			a := line.attempts[runs]
+			runs++
+			return a.out, append([]string{"go", "test", "-v"}, extra...), a.exitCode, nil
+		})
+		if (err != nil) != line.fail {
+			t.Errorf("%s: unexpected error %v", line.name, err)
+		}
+		if runs != line.runs {
+			t.Errorf("%s: go test ran %d times, expected %d", line.name, runs, line.runs)
+		}
+		tests, _ := r.sorted()
+		var flaky, quarantined []string
+		for _, test := range tests {
+			if test.Flaky {
+				flaky = append(flaky, test.Name)
+			}
+			if test.Quarantined {
+				quarantined = append(quarantined, test.Name)
+			}
+		}
+		if !reflect.DeepEqual(flaky, line.flaky) {
+			t.Errorf("%s: flaky tests %v, expected %v", line.name, flaky, line.flaky)
+		}
+		if !reflect.DeepEqual(quarantined, line.quarantined) {
+			t.Errorf("%s: quarantined tests %v, expected %v", line.name, quarantined, line.quarantined)
+		}
+	}
+}
+
+func TestRunTestsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := runTests(ctx, "foo/bar", "bar", 0, nil, func(extra ...string) (string, []string, int, error) {
+		return "", []string{"go", "test"}, -1, ctx.Err()
+	})
+	if _, ok := err.(*Failure); ok || err == nil {
+		t.Fatalf("expected a plain error for a package not run, got %#v", err)
+	}
+}
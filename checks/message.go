@@ -0,0 +1,261 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package checks
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CommitMessage is a commit message about to be committed, along with the
+// context needed to check it.
+type CommitMessage struct {
+	// Message is the commit message, without the comment lines.
+	Message string
+	// Branch is the branch being committed to, e.g. "master". It is empty on a
+	// detached HEAD.
+	Branch string
+	// Committer is the identity of the committer, e.g. "Joe <joe@example.com>".
+	Committer string
+}
+
+// Subject returns the first line of the commit message.
+func (m *CommitMessage) Subject() string {
+	return strings.SplitN(strings.TrimSpace(m.Message), "\n", 2)[0]
+}
+
+// Trailers returns the lines of the last paragraph of the commit message,
+// which is where the trailers like "Signed-off-by:" are. It returns nothing
+// if the message is only a subject.
+func (m *CommitMessage) Trailers() []string {
+	paragraphs := strings.Split(strings.TrimSpace(m.Message), "\n\n")
+	if len(paragraphs) < 2 {
+		return nil
+	}
+	return strings.Split(strings.TrimSpace(paragraphs[len(paragraphs)-1]), "\n")
+}
+
+// MessageCheck describes a check to be executed on the commit message, by
+// the commit-msg git hook.
+type MessageCheck interface {
+	// GetRunLevel is the level at which this check should be run.
+	GetRunLevel() int
+	// GetDescription returns the check description.
+	GetDescription() string
+	// GetName returns the check name.
+	GetName() string
+	// ResetDefault resets the check to its default values.
+	ResetDefault()
+	// Validate returns a *ConfigError if a value of the check configuration is
+	// invalid.
+	Validate() error
+	// RunMessage executes the check on the commit message.
+	RunMessage(m *CommitMessage) error
+}
+
+// messageCheck exists to reduce the noise in the doc.
+type messageCheck interface {
+	getRunLevel() int
+	getDescription() string
+	getName() string
+	resetDefault()
+	validate() error
+	runMessage(m *CommitMessage) error
+}
+
+type messageCheckAdaptor struct {
+	messageCheck
+}
+
+func (c messageCheckAdaptor) GetRunLevel() int {
+	return c.getRunLevel()
+}
+func (c messageCheckAdaptor) GetDescription() string {
+	return c.getDescription()
+}
+func (c messageCheckAdaptor) GetName() string {
+	return c.getName()
+}
+func (c messageCheckAdaptor) ResetDefault() {
+	c.resetDefault()
+}
+func (c messageCheckAdaptor) Validate() error {
+	return c.validate()
+}
+func (c messageCheckAdaptor) RunMessage(m *CommitMessage) error {
+	return c.runMessage(m)
+}
+
+// SubjectLength enforces a maximum length on the first line of the commit
+// message.
+type SubjectLength struct {
+	CheckCommon `yaml:",inline"`
+	// Maximum number of characters in the subject. Default is 72.
+	MaxLength int
+}
+
+func (s *SubjectLength) Check() MessageCheck {
+	return messageCheckAdaptor{s}
+}
+
+func (s *SubjectLength) getDescription() string {
+	return "enforces a maximum length on the commit message subject line"
+}
+
+func (s *SubjectLength) getName() string {
+	return "subjectlength"
+}
+
+func (s *SubjectLength) resetDefault() {
+	s.RunLevel = 1
+	s.MaxDuration = 0
+	s.MaxLength = 72
+}
+
+func (s *SubjectLength) validate() error {
+	if err := s.CheckCommon.validate(); err != nil {
+		return err
+	}
+	if s.MaxLength <= 0 {
+		return &ConfigError{"maxlength", fmt.Sprintf("must be positive, got %d", s.MaxLength)}
+	}
+	return nil
+}
+
+func (s *SubjectLength) runMessage(m *CommitMessage) error {
+	subject := m.Subject()
+	if subject == "" {
+		return fmt.Errorf("the commit message subject is empty")
+	}
+	if l := len([]rune(subject)); l > s.MaxLength {
+		return fmt.Errorf("the commit message subject is %d characters long, the maximum is %d:\n%s", l, s.MaxLength, subject)
+	}
+	return nil
+}
+
+// Trailer enforces that the commit message contains a trailer line matching
+// a regular expression, e.g. to reference a bug.
+type Trailer struct {
+	CheckCommon `yaml:",inline"`
+	// Regular expression that one of the trailer lines must match. Default is
+	// "^(Bug|Fixes): .+".
+	Regexp string
+}
+
+func (t *Trailer) Check() MessageCheck {
+	return messageCheckAdaptor{t}
+}
+
+func (t *Trailer) getDescription() string {
+	return "enforces the commit message has a trailer like 'Bug:' or 'Fixes:'"
+}
+
+func (t *Trailer) getName() string {
+	return "trailer"
+}
+
+func (t *Trailer) resetDefault() {
+	t.RunLevel = 0
+	t.MaxDuration = 0
+	t.Regexp = "^(Bug|Fixes): .+"
+}
+
+func (t *Trailer) validate() error {
+	if err := t.CheckCommon.validate(); err != nil {
+		return err
+	}
+	if _, err := regexp.Compile(t.Regexp); err != nil {
+		return &ConfigError{"regexp", fmt.Sprintf("is invalid: %s", err)}
+	}
+	return nil
+}
+
+func (t *Trailer) runMessage(m *CommitMessage) error {
+	re, err := regexp.Compile(t.Regexp)
+	if err != nil {
+		return fmt.Errorf("invalid trailer regexp %q: %s", t.Regexp, err)
+	}
+	for _, line := range m.Trailers() {
+		if re.MatchString(line) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the commit message must have a trailer line matching %q", t.Regexp)
+}
+
+// NoWIP refuses commits marked as work in progress on protected branches.
+type NoWIP struct {
+	CheckCommon `yaml:",inline"`
+	// Branches where WIP commits are refused. Default is master.
+	ProtectedBranches []string
+}
+
+// wipRe matches a subject marked as work in progress, e.g. "WIP: foo" or
+// "[wip] foo".
+var wipRe = regexp.MustCompile(`(?i)^\W*wip\b`)
+
+func (n *NoWIP) Check() MessageCheck {
+	return messageCheckAdaptor{n}
+}
+
+func (n *NoWIP) getDescription() string {
+	return "refuses work in progress commits on protected branches"
+}
+
+func (n *NoWIP) getName() string {
+	return "nowip"
+}
+
+func (n *NoWIP) resetDefault() {
+	n.RunLevel = 1
+	n.MaxDuration = 0
+	n.ProtectedBranches = []string{"master"}
+}
+
+func (n *NoWIP) runMessage(m *CommitMessage) error {
+	if !wipRe.MatchString(m.Subject()) {
+		return nil
+	}
+	for _, b := range n.ProtectedBranches {
+		if b == m.Branch {
+			return fmt.Errorf("work in progress commits are not allowed on branch %s", m.Branch)
+		}
+	}
+	return nil
+}
+
+// SignOff enforces that the commit message is signed off by the committer,
+// like 'git commit -s' does.
+type SignOff struct {
+	CheckCommon `yaml:",inline"`
+}
+
+func (s *SignOff) Check() MessageCheck {
+	return messageCheckAdaptor{s}
+}
+
+func (s *SignOff) getDescription() string {
+	return "enforces the commit message is signed off by the committer"
+}
+
+func (s *SignOff) getName() string {
+	return "signoff"
+}
+
+func (s *SignOff) resetDefault() {
+	s.RunLevel = 0
+	s.MaxDuration = 0
+}
+
+func (s *SignOff) runMessage(m *CommitMessage) error {
+	expected := "Signed-off-by: " + m.Committer
+	for _, line := range m.Trailers() {
+		if strings.TrimSpace(line) == expected {
+			return nil
+		}
+	}
+	return fmt.Errorf("the commit message must be signed off with:\n%s", expected)
+}
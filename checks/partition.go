@@ -0,0 +1,328 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package checks
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Partition is a check to be run only on a subset of the packages of the
+// tree, e.g. a subtree with its own configuration.
+type Partition struct {
+	// Dirs are the absolute directories of the packages.
+	Dirs []string
+	// Check is the check configured for these packages.
+	Check Check
+}
+
+// PackageDirs returns the absolute directories of all the packages of the
+// tree, with or without tests, sorted.
+func PackageDirs() []string {
+	out := []string{}
+	out = append(out, goDirs(false)...)
+	out = append(out, goDirs(true)...)
+	sort.Strings(out)
+	return out
+}
+
+// Partitioned returns a check running on each package the check returned by
+// checkFor for its directory. checkFor returns nil if the check is not to be
+// run on the package.
+//
+// The packages are grouped by check configuration and the check of each group
+// is run on its packages only. It returns the check itself when all the
+// packages share the same configuration and nil when the check is not to be
+// run on any package.
+func Partitioned(checkFor func(dir string) Check) Check {
+	all := PackageDirs()
+	parts := []Partition{}
+	index := map[string]int{}
+	for _, d := range all {
+		c := checkFor(d)
+		if c == nil {
+			continue
+		}
+		key := string(checkConfig(c))
+		i, ok := index[key]
+		if !ok {
+			i = len(parts)
+			index[key] = i
+			parts = append(parts, Partition{Check: c})
+		}
+		parts[i].Dirs = append(parts[i].Dirs, d)
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	if len(parts) == 1 && len(parts[0].Dirs) == len(all) {
+		return parts[0].Check
+	}
+	return partitioned(parts)
+}
+
+// ForChange returns the check restricted to the partitions with packages
+// affected by change, or nil if the change affects none of the packages the
+// check looks at.
+func ForChange(check Check, change *Change) Check {
+	if change == nil {
+		return check
+	}
+	affected := change.affectedDirs()
+	p, ok := check.(partitioned)
+	if !ok {
+		if len(affected) == 0 {
+			return nil
+		}
+		return check
+	}
+	out := partitioned{}
+	for _, part := range p {
+		for _, d := range part.Dirs {
+			if _, ok := affected[d]; ok {
+				out = append(out, part)
+				break
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// checkConfig returns the configuration of check, serialized.
+func checkConfig(check Check) []byte {
+	var v interface{} = check
+	switch c := check.(type) {
+	case checkAdaptor:
+		v = c.check
+	case partitioned:
+		type part struct {
+			Dirs   []string
+			Config json.RawMessage
+		}
+		parts := []part{}
+		for _, p := range c {
+			parts = append(parts, part{p.Dirs, checkConfig(p.Check)})
+		}
+		v = parts
+	}
+	out, _ := json.Marshal(v)
+	return out
+}
+
+// checksOf returns the checks run by check, that is the check of each
+// partition for a partitioned check.
+func checksOf(check Check) []Check {
+	p, ok := check.(partitioned)
+	if !ok {
+		return []Check{check}
+	}
+	out := make([]Check, 0, len(p))
+	for _, part := range p {
+		out = append(out, part.Check)
+	}
+	return out
+}
+
+// partitioned runs a check on each partition of the tree.
+type partitioned []Partition
+
+func (p partitioned) GetRunLevel() int {
+	out := p[0].Check.GetRunLevel()
+	for _, part := range p[1:] {
+		if l := part.Check.GetRunLevel(); l < out {
+			out = l
+		}
+	}
+	return out
+}
+
+func (p partitioned) GetMaxDuration() int {
+	out := 0
+	for _, part := range p {
+		if d := part.Check.GetMaxDuration(); d > out {
+			out = d
+		}
+	}
+	return out
+}
+
+func (p partitioned) GetDescription() string {
+	return p[0].Check.GetDescription()
+}
+
+func (p partitioned) GetName() string {
+	return p[0].Check.GetName()
+}
+
+func (p partitioned) GetPrerequisites() []CheckPrerequisite {
+	out := []CheckPrerequisite{}
+	seen := map[string]bool{}
+	for _, part := range p {
+		for _, c := range part.Check.GetPrerequisites() {
+			if !seen[c.URL] {
+				seen[c.URL] = true
+				out = append(out, c)
+			}
+		}
+	}
+	return out
+}
+
+func (p partitioned) GetDependsOn() []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, part := range p {
+		for _, d := range part.Check.GetDependsOn() {
+			if !seen[d] {
+				seen[d] = true
+				out = append(out, d)
+			}
+		}
+	}
+	return out
+}
+
+func (p partitioned) IsConcurrent() bool {
+	for _, part := range p {
+		if !part.Check.IsConcurrent() {
+			return false
+		}
+	}
+	return true
+}
+
+func (p partitioned) ResetDefault() {
+	for _, part := range p {
+		part.Check.ResetDefault()
+	}
+}
+
+func (p partitioned) Validate() error {
+	for _, part := range p {
+		if err := part.Check.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run runs the check of each partition and merges their results. The
+// partitions of a check that is not concurrent are run one after the other.
+func (p partitioned) Run(ctx context.Context, change *Change) *Result {
+	start := time.Now()
+	results := make([]*Result, len(p))
+	var wg sync.WaitGroup
+	for i, part := range p {
+		if !part.Check.IsConcurrent() {
+			results[i] = part.Check.Run(withScope(ctx, part.Dirs), change)
+			continue
+		}
+		wg.Add(1)
+		go func(i int, part Partition) {
+			defer wg.Done()
+			results[i] = part.Check.Run(withScope(ctx, part.Dirs), change)
+		}(i, part)
+	}
+	wg.Wait()
+	r := &Result{Name: p.GetName(), Status: Passed, Duration: time.Now().Sub(start)}
+	errs := []error{}
+	for _, res := range results {
+		r.Findings = append(r.Findings, res.Findings...)
+		r.Tests = append(r.Tests, res.Tests...)
+		r.Packages = append(r.Packages, res.Packages...)
+		if res.Err != nil {
+			errs = append(errs, res.Err)
+		}
+		if res.Status == TimedOut || (res.Status == Failed && r.Status == Passed) {
+			r.Status = res.Status
+		}
+	}
+	sort.Stable(testsByPackage(r.Tests))
+	sort.Sort(timingsByPackage(r.Packages))
+	r.Err = joinFailures(errs)
+	return r
+}
+
+type scopeKey struct{}
+
+// withScope returns a context for a check that must only look at the
+// packages in the absolute directories dirs.
+func withScope(ctx context.Context, dirs []string) context.Context {
+	return context.WithValue(ctx, scopeKey{}, dirs)
+}
+
+// scope returns the directories of the packages the check must look at, and
+// false if it must look at the whole tree.
+func scope(ctx context.Context) ([]string, bool) {
+	dirs, ok := ctx.Value(scopeKey{}).([]string)
+	return dirs, ok
+}
+
+// inScope returns the directories of dirs the check must look at.
+func inScope(ctx context.Context, dirs []string) []string {
+	s, ok := scope(ctx)
+	if !ok {
+		return dirs
+	}
+	in := map[string]bool{}
+	for _, d := range s {
+		in[d] = true
+	}
+	out := []string{}
+	for _, d := range dirs {
+		if in[d] {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// filesInScope returns the files, relative to the root of the checkout, the
+// check must look at.
+func filesInScope(ctx context.Context, files []string) []string {
+	s, ok := scope(ctx)
+	if !ok {
+		return files
+	}
+	in := map[string]bool{}
+	for _, d := range s {
+		in[d] = true
+	}
+	root, _ := os.Getwd()
+	out := []string{}
+	for _, f := range files {
+		if in[filepath.Join(root, filepath.Dir(f))] {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// scopeGoFiles returns the .go files of the packages in the scope of ctx,
+// relative to the root of the checkout.
+func scopeGoFiles(ctx context.Context) []string {
+	dirs, _ := scope(ctx)
+	root, _ := os.Getwd()
+	out := []string{}
+	for _, d := range dirs {
+		for _, f := range readDirNames(d) {
+			if strings.HasSuffix(f, ".go") && f[0] != '.' && f[0] != '_' {
+				if rel, err := filepath.Rel(root, filepath.Join(d, f)); err == nil {
+					out = append(out, rel)
+				}
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,274 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package checks
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status is the outcome of a check.
+type Status string
+
+const (
+	// Passed means the check found no problem.
+	Passed Status = "pass"
+	// Failed means the check found problems or could not run.
+	Failed Status = "fail"
+	// TimedOut means the check was killed after exceeding its maximum
+	// duration.
+	TimedOut Status = "timeout"
+	// Skipped means the check was not run, or was killed before completing
+	// because another check failed.
+	Skipped Status = "skipped"
+)
+
+// Severity is the importance of a Finding.
+type Severity string
+
+const (
+	// Error is a problem that must be fixed.
+	Error Severity = "error"
+	// Warning is a problem that may be a false positive, like golint's.
+	Warning Severity = "warning"
+)
+
+// Finding is a single problem found by a check, e.g. one line of golint
+// output.
+type Finding struct {
+	// File is the path of the file relative to the root of the checkout, with
+	// forward slashes. It is empty if the problem is not about a file.
+	File string `json:"file,omitempty"`
+	// Line is 1-based, 0 if unknown.
+	Line int `json:"line,omitempty"`
+	// Column is 1-based, 0 if unknown.
+	Column int `json:"column,omitempty"`
+	// Severity is the importance of the problem.
+	Severity Severity `json:"severity"`
+	// Message describes the problem.
+	Message string `json:"message"`
+	// Rule identifies the kind of problem, e.g. "naming" for golint. It is
+	// the tool name when the tool doesn't tell.
+	Rule string `json:"rule"`
+	// Tool is the tool that reported the problem, e.g. "golint".
+	Tool string `json:"tool"`
+}
+
+// String returns the finding formatted like compilers do, e.g.
+// "foo/bar.go:12:3: message".
+func (f *Finding) String() string {
+	loc := f.File
+	if loc != "" && f.Line != 0 {
+		loc += ":" + strconv.Itoa(f.Line)
+		if f.Column != 0 {
+			loc += ":" + strconv.Itoa(f.Column)
+		}
+	}
+	if loc == "" {
+		return f.Message
+	}
+	return loc + ": " + f.Message
+}
+
+// Result is the outcome of running a check.
+type Result struct {
+	// Name is the check name.
+	Name string
+	// Status is the outcome of the check.
+	Status Status
+	// Duration is how long the check ran.
+	Duration time.Duration
+	// Findings are the problems found by the check, if any.
+	Findings []Finding
+	// Tests are the Go tests run by the check, if any. They are only known
+	// when go test is run with -v.
+	Tests []TestCase
+	// Packages is how long the tests of each package took, for the checks
+	// running go test.
+	Packages []PackageTiming
+	// Cached is true if the check was not run because it passed on the same
+	// sources before. See Cache.
+	Cached bool
+	// Err is nil if the check passed. It is a *Failure when the check found
+	// problems.
+	Err error
+}
+
+// Failure is the error returned by a check that found problems. Its text is
+// derived from the findings.
+type Failure struct {
+	// Summary describes the failure, e.g. the command that failed.
+	Summary string
+	// Findings are the problems found.
+	Findings []Finding
+	// Output is the raw output of the tool, when it has more context than the
+	// findings, e.g. the output of a test. When set, it is shown instead of the
+	// findings.
+	Output string
+}
+
+func (f *Failure) Error() string {
+	lines := []string{}
+	if f.Summary != "" {
+		lines = append(lines, f.Summary)
+	}
+	if f.Output != "" {
+		lines = append(lines, strings.TrimRight(f.Output, "\n"))
+	} else {
+		for i := range f.Findings {
+			lines = append(lines, f.Findings[i].String())
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// joinFailures merges the errors returned while checking multiple packages
+// concurrently. It returns nil if errs is empty.
+func joinFailures(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	// The errors come from goroutines, sort them for stable output.
+	sort.Sort(errorsByText(errs))
+	out := &Failure{}
+	texts := make([]string, 0, len(errs))
+	for _, err := range errs {
+		if f, ok := err.(*Failure); ok {
+			out.Findings = append(out.Findings, f.Findings...)
+		}
+		texts = append(texts, err.Error())
+	}
+	out.Output = strings.Join(texts, "\n")
+	return out
+}
+
+type errorsByText []error
+
+func (e errorsByText) Len() int           { return len(e) }
+func (e errorsByText) Less(i, j int) bool { return e[i].Error() < e[j].Error() }
+func (e errorsByText) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+type findingsByLocation []Finding
+
+func (f findingsByLocation) Len() int      { return len(f) }
+func (f findingsByLocation) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f findingsByLocation) Less(i, j int) bool {
+	if f[i].File != f[j].File {
+		return f[i].File < f[j].File
+	}
+	if f[i].Line != f[j].Line {
+		return f[i].Line < f[j].Line
+	}
+	return f[i].Column < f[j].Column
+}
+
+// filterBlacklist returns the findings whose message contains none of the
+// blacklisted strings.
+func filterBlacklist(findings []Finding, blacklist []string) []Finding {
+	out := []Finding{}
+outer:
+	for _, f := range findings {
+		for _, b := range blacklist {
+			if strings.Contains(f.Message, b) {
+				continue outer
+			}
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// drain returns the errors buffered in the closed channel errs.
+func drain(errs <-chan error) []error {
+	out := []error{}
+	for err := range errs {
+		out = append(out, err)
+	}
+	return out
+}
+
+// locationRe matches a line starting with a source location, as printed by
+// the compiler and most Go tools, e.g. "foo/bar.go:12:3: message" or
+// "bar_test.go:12: message".
+var locationRe = regexp.MustCompile(`^\s*(.+?\.go):(\d+)(?::(\d+))?:\s*(.*)$`)
+
+// parseLocation parses a line starting with a source location. Relative paths
+// are relative to dir, itself relative to the root of the checkout.
+func parseLocation(line, dir, tool string, severity Severity) (Finding, bool) {
+	m := locationRe.FindStringSubmatch(line)
+	if m == nil {
+		return Finding{}, false
+	}
+	f := Finding{File: relFile(dir, m[1]), Severity: severity, Message: m[4], Tool: tool, Rule: tool}
+	f.Line, _ = strconv.Atoi(m[2])
+	f.Column, _ = strconv.Atoi(m[3])
+	return f, true
+}
+
+// parseLocations returns a finding for each line of out starting with a
+// source location. Other lines are ignored.
+func parseLocations(out, dir, tool string, severity Severity) []Finding {
+	findings := []Finding{}
+	for _, line := range strings.Split(out, "\n") {
+		if f, ok := parseLocation(line, dir, tool, severity); ok {
+			findings = append(findings, f)
+		}
+	}
+	return findings
+}
+
+// parseFileList returns a finding for each file listed in out, one per line,
+// like 'gofmt -l' prints.
+func parseFileList(out, tool, message string) []Finding {
+	findings := []Finding{}
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			findings = append(findings, Finding{File: relFile("", line), Severity: Error, Message: message, Tool: tool, Rule: tool})
+		}
+	}
+	return findings
+}
+
+// relFile returns the path p relative to the root of the checkout, with
+// forward slashes. A relative p is relative to dir if it exists there,
+// otherwise it is assumed to be relative to the root.
+func relFile(dir, p string) string {
+	if filepath.IsAbs(p) {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, p); err == nil && !strings.HasPrefix(rel, "..") {
+				p = rel
+			}
+		}
+	} else if dir != "" {
+		if _, err := os.Stat(filepath.Join(dir, p)); err == nil {
+			p = filepath.Join(dir, p)
+		}
+	}
+	return filepath.ToSlash(filepath.Clean(p))
+}
+
+// relDir returns the directory d relative to the root of the checkout.
+func relDir(d string) string {
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, d); err == nil {
+			return rel
+		}
+	}
+	return d
+}
+
+// describe is a shorthand to describe a command that failed.
+func describe(args []string) string {
+	return fmt.Sprintf("%s failed:", strings.Join(args, " "))
+}
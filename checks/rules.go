@@ -0,0 +1,97 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package checks
+
+import "regexp"
+
+// rule identifies the kind of problem reported by a tool that only prints
+// messages, by a regexp matching the messages.
+type rule struct {
+	re *regexp.Regexp
+	id string
+}
+
+func newRule(expr, id string) rule {
+	return rule{regexp.MustCompile(expr), id}
+}
+
+// golintRules maps golint messages to the categories golint uses internally.
+// The first match wins.
+var golintRules = []rule{
+	newRule(`^should have a package comment`, "package-comments"),
+	newRule(`^package comment (should|is detached)`, "package-comments"),
+	newRule(`^exported \S+ \S+ should have comment`, "comments"),
+	newRule(`^comment on exported \S+ \S+ should be of the form `, "comments"),
+	newRule(`^exported \S+ \S+ should have its own declaration$`, "comments"),
+	newRule(`^should not use dot imports$`, "imports"),
+	newRule(`^a blank import should be only in a main or test package`, "imports"),
+	newRule(`^error strings should not be capitalized`, "errors"),
+	newRule(`^should replace \S+\(fmt\.Sprintf\(\.\.\.\)\) with \S+\(\.\.\.\)$`, "errors"),
+	newRule(`^error var \S+ should have name of the form `, "naming"),
+	newRule(`^error should be the last type when returning multiple items$`, "arg-order"),
+	newRule(`^context\.Context should be the first parameter of a function$`, "arg-order"),
+	newRule(`^should omit (2nd value|values) from range; `, "range-loop"),
+	newRule(`^if block ends with a return statement, so drop this else and outdent its block`, "indent"),
+	newRule(`^receiver name `, "naming"),
+	newRule(`^should not use basic type \S+ as key in context\.WithValue$`, "context"),
+	newRule(`^exported \S+ \S+ returns unexported type \S+, which can be annoying to use$`, "unexported-type-in-api"),
+	newRule(`^var \S+ is of type \S+; don't use unit-specific suffix `, "time"),
+	newRule(`^should replace \S+ [-+]= 1 with \S+(\+\+|--)$`, "unary-op"),
+	newRule(`^should drop = .+ from declaration of var \S+; it is the zero value$`, "zero-value"),
+	newRule(`^should omit type \S+ from declaration of var \S+; it will be inferred from the right-hand side$`, "type-inference"),
+	newRule(`^don't use (ALL_CAPS|leading k|underscores|an underscore|MixedCaps) in `, "naming"),
+	newRule(`^(func|method|var|const|type|struct field|interface method|range var|func parameter|func result|method parameter|method result) \S+ should be \S+$`, "naming"),
+	newRule(`^type name will be used as \S+ by other packages, and that stutters; `, "naming"),
+}
+
+// govetRules maps vet messages to the name of the vet analysis.
+var govetRules = []rule{
+	newRule(`^unreachable code$`, "unreachable"),
+	newRule(`^(\S+ )?composite literal uses unkeyed fields$`, "composites"),
+	newRule(`^struct field (tag \S+ not compatible with reflect\.StructTag\.Get|\S+ repeats \S+ tag)`, "structtag"),
+	newRule(`^(assignment|return|literal|call of \S+|range var \S+) copies lock`, "copylocks"),
+	newRule(`^\S+ passes lock by value: `, "copylocks"),
+	newRule(`^self-assignment of \S+ to \S+$`, "assign"),
+	newRule(`^direct assignment to atomic value$`, "atomic"),
+	newRule(`^result of \S+ call not used$`, "unusedresult"),
+	newRule(`^declaration of "\S+" shadows declaration at `, "shadow"),
+	newRule(`^possible misuse of unsafe\.Pointer$`, "unsafeptr"),
+	newRule(`^(suspect|redundant) (or|and): `, "bools"),
+	newRule(`^comparison of function \S+ (==|!=) nil is always (true|false)$`, "nilfunc"),
+	newRule(`^method \S+ should have signature `, "stdmethods"),
+	newRule(`^(range|loop) variable \S+ captured by func literal$`, "loopclosure"),
+	newRule(`^the cancel function `, "lostcancel"),
+	newRule(`^\S+ \(\d+ bits\) too small for shift of \d+$`, "shift"),
+	newRule(`^(possible malformed )?\+build comment`, "buildtag"),
+	newRule(`^\w+ format \S+ (has|reads|is missing|uses)`, "printf"),
+	newRule(`^missing argument for \w+\(`, "printf"),
+	newRule(`^\w+ call (needs \d+ args?|has possible formatting directive|has arguments but no formatting directives)`, "printf"),
+	newRule(`^(possible|no) formatting directive in \w+ call$`, "printf"),
+	newRule(`^\w+ arg list ends with redundant newline$`, "printf"),
+	newRule(`^unrecognized printf (verb|flag) `, "printf"),
+	newRule(`^arg \S+ for printf verb `, "printf"),
+	newRule(`^first argument to \w+ is os\.Std(out|err)$`, "printf"),
+}
+
+// classify sets the rule of each finding according to the first rule
+// matching its message. The findings matching none keep the tool name as
+// their rule.
+func classify(findings []Finding, rules []rule) {
+	for i := range findings {
+		for _, r := range rules {
+			if r.re.MatchString(findings[i].Message) {
+				findings[i].Rule = r.id
+				break
+			}
+		}
+	}
+}
+
+// setRule sets the rule of all the findings.
+func setRule(findings []Finding, id string) {
+	for i := range findings {
+		findings[i].Rule = id
+	}
+}
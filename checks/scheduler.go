@@ -0,0 +1,152 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package checks
+
+import (
+	"container/heap"
+	"context"
+	"runtime"
+	"sync"
+)
+
+// Globals
+
+// jobs limits the number of subprocesses run concurrently by all the checks.
+var jobs = newScheduler(runtime.NumCPU())
+
+// expectedCost ranks the built-in checks from the fastest to the slowest. The
+// subprocesses of the fastest checks are started first, so that cheap
+// failures surface quickly. Custom checks rank in the middle.
+var expectedCost = map[string]int{
+	"gofmt":        0,
+	"goimports":    1,
+	"golint":       2,
+	"govet":        2,
+	"errcheck":     3,
+	"build":        4,
+	"test":         5,
+	"testcoverage": 6,
+}
+
+// SetJobs sets the maximum number of subprocesses run concurrently by all the
+// checks. n <= 0 means the number of CPUs. It must be called before running
+// any check.
+func SetJobs(n int) {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	jobs = newScheduler(n)
+}
+
+type priorityKey struct{}
+
+// withPriority returns a context for the subprocesses of the check name.
+func withPriority(ctx context.Context, name string) context.Context {
+	cost, ok := expectedCost[name]
+	if !ok {
+		cost = 3
+	}
+	return context.WithValue(ctx, priorityKey{}, cost)
+}
+
+// waiter is a subprocess waiting for its turn to start.
+type waiter struct {
+	priority int
+	seq      int
+	index    int
+	ready    chan struct{}
+}
+
+// waiters is a priority queue of waiter, implementing heap.Interface. Lower
+// priority values go first, then first come, first served.
+type waiters []*waiter
+
+func (w waiters) Len() int {
+	return len(w)
+}
+
+func (w waiters) Less(i, j int) bool {
+	if w[i].priority != w[j].priority {
+		return w[i].priority < w[j].priority
+	}
+	return w[i].seq < w[j].seq
+}
+
+func (w waiters) Swap(i, j int) {
+	w[i], w[j] = w[j], w[i]
+	w[i].index = i
+	w[j].index = j
+}
+
+func (w *waiters) Push(x interface{}) {
+	item := x.(*waiter)
+	item.index = len(*w)
+	*w = append(*w, item)
+}
+
+func (w *waiters) Pop() interface{} {
+	old := *w
+	n := len(old)
+	item := old[n-1]
+	item.index = -1
+	*w = old[:n-1]
+	return item
+}
+
+// scheduler hands out a limited number of job slots by priority.
+type scheduler struct {
+	lock      sync.Mutex
+	available int
+	seq       int
+	queue     waiters
+}
+
+func newScheduler(n int) *scheduler {
+	return &scheduler{available: n}
+}
+
+// acquire blocks until a job slot is available for the priority in ctx or
+// until ctx is done.
+func (s *scheduler) acquire(ctx context.Context) error {
+	priority, _ := ctx.Value(priorityKey{}).(int)
+	s.lock.Lock()
+	if s.available > 0 && len(s.queue) == 0 {
+		s.available--
+		s.lock.Unlock()
+		return nil
+	}
+	w := &waiter{priority: priority, seq: s.seq, ready: make(chan struct{})}
+	s.seq++
+	heap.Push(&s.queue, w)
+	s.lock.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.lock.Lock()
+		if w.index >= 0 {
+			heap.Remove(&s.queue, w.index)
+			s.lock.Unlock()
+		} else {
+			// The slot was handed out concurrently, give it back.
+			s.lock.Unlock()
+			s.release()
+		}
+		return ctx.Err()
+	}
+}
+
+// release returns a job slot, handing it to the highest priority waiter if
+// any.
+func (s *scheduler) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.queue) != 0 {
+		close(heap.Pop(&s.queue).(*waiter).ready)
+		return
+	}
+	s.available++
+}
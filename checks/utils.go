@@ -5,6 +5,8 @@
 package checks
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -19,7 +21,7 @@ import (
 // Globals
 
 var goDirsCacheLock sync.Mutex
-var goDirsCache map[bool][]string
+var goDirsCache = map[string]map[bool][]string{}
 
 var relToGOPATHLock sync.Mutex
 var relToGOPATHCache = map[string]string{}
@@ -36,30 +38,73 @@ func readDirNames(dirname string) []string {
 
 // captureWd runs an executable from a directory returns the output, exit code
 // and error if appropriate.
-func captureWd(wd string, args ...string) (string, int, error) {
+//
+// When ctx is done before the executable completes, the executable and all
+// its child processes are killed and the output so far is returned along with
+// ctx.Err(). When ctx is done before the executable starts, e.g. while it waits
+// for a job slot, ctx.Err() is returned with an exit code of -1 and no output.
+func captureWd(ctx context.Context, wd string, args ...string) (string, int, error) {
+	return captureEnv(ctx, wd, nil, args...)
+}
+
+// captureEnv is like captureWd() with the environment variables env, like
+// "NAME=value", added to the ones of the process.
+func captureEnv(ctx context.Context, wd string, env []string, args ...string) (string, int, error) {
+	if err := ctx.Err(); err != nil {
+		return "", -1, err
+	}
+	// Wait for a job slot so that the checks do not overload the machine.
+	s := jobs
+	if err := s.acquire(ctx); err != nil {
+		return "", -1, err
+	}
+	defer s.release()
 	exitCode := -1
 	log.Printf("capture(%s)", args)
 	c := exec.Command(args[0], args[1:]...)
 	if wd != "" {
 		c.Dir = wd
 	}
-	out, err := c.CombinedOutput()
+	if len(env) != 0 {
+		c.Env = append(os.Environ(), env...)
+	}
+	out := &bytes.Buffer{}
+	c.Stdout = out
+	c.Stderr = out
+	setProcessGroup(c)
+	killed := false
+	err := c.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() {
+			done <- c.Wait()
+		}()
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			log.Printf("killing %s: %s", args, ctx.Err())
+			killProcessGroup(c.Process)
+			<-done
+			err = ctx.Err()
+			killed = true
+		}
+	}
 	if c.ProcessState != nil {
 		if waitStatus, ok := c.ProcessState.Sys().(syscall.WaitStatus); ok {
 			exitCode = waitStatus.ExitStatus()
-			if exitCode != 0 {
+			if exitCode != 0 && !killed {
 				err = nil
 			}
 		}
 	}
 	// TODO(maruel): Handle code page on Windows.
-	return string(out), exitCode, err
+	return out.String(), exitCode, err
 }
 
 // capture runs an executable and returns the output, exit code and error if
 // appropriate.
-func capture(args ...string) (string, int, error) {
-	return captureWd("", args...)
+func capture(ctx context.Context, args ...string) (string, int, error) {
+	return captureWd(ctx, "", args...)
 }
 
 // reverse reverses a string.
@@ -93,13 +138,15 @@ func rsplitn(s, sep string, n int) []string {
 // If 'tests' is true, all directories containing tests are returned.
 // If 'tests' is false, only directories containing go source files but not
 // tests are returned. This is usually 'main' packages.
+//
+// The result is cached per current working directory.
 func goDirs(tests bool) []string {
 	goDirsCacheLock.Lock()
 	defer goDirsCacheLock.Unlock()
-	if goDirsCache != nil {
-		return goDirsCache[tests]
-	}
 	root, _ := os.Getwd()
+	if cache, ok := goDirsCache[root]; ok {
+		return cache[tests]
+	}
 	if stat, err := os.Stat(root); err != nil || !stat.IsDir() {
 		panic("internal failure")
 	}
@@ -129,26 +176,36 @@ func goDirs(tests bool) []string {
 		}
 	}
 	recurse(root)
-	goDirsCache = map[bool][]string{
+	cache := map[bool][]string{
 		false: make([]string, 0, len(dirsSourceFound)),
 		true:  make([]string, 0, len(dirsTestsFound)),
 	}
 	for d := range dirsSourceFound {
 		if _, ok := dirsTestsFound[d]; !ok {
-			goDirsCache[false] = append(goDirsCache[false], d)
+			cache[false] = append(cache[false], d)
 		}
 	}
 	for d := range dirsTestsFound {
-		goDirsCache[true] = append(goDirsCache[true], d)
+		cache[true] = append(cache[true], d)
 	}
-	sort.Strings(goDirsCache[false])
-	sort.Strings(goDirsCache[true])
-	//log.Printf("goDirs() = %v", goDirsCache)
-	return goDirsCache[tests]
+	sort.Strings(cache[false])
+	sort.Strings(cache[true])
+	goDirsCache[root] = cache
+	//log.Printf("goDirs() = %v", cache)
+	return cache[tests]
+}
+
+// Rescan forgets the directories found by goDirs() in the current working
+// directory, so that the packages added or removed since are seen.
+func Rescan() {
+	goDirsCacheLock.Lock()
+	defer goDirsCacheLock.Unlock()
+	root, _ := os.Getwd()
+	delete(goDirsCache, root)
 }
 
-// relToGOPATH returns the path relative to $GOPATH/src.
-func relToGOPATH(p string) (string, error) {
+// RelToGOPATH returns the path relative to $GOPATH/src.
+func RelToGOPATH(p string) (string, error) {
 	relToGOPATHLock.Lock()
 	defer relToGOPATHLock.Unlock()
 	if rel, ok := relToGOPATHCache[p]; ok {
@@ -0,0 +1,23 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package checks
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// setProcessGroup is a no-op on Windows, the process tree is killed by
+// killProcessGroup.
+func setProcessGroup(c *exec.Cmd) {
+}
+
+// killProcessGroup kills the process and all its children.
+func killProcessGroup(p *os.Process) {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(p.Pid)).Run(); err != nil {
+		_ = p.Kill()
+	}
+}
@@ -0,0 +1,628 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/maruel/pre-commit-go/checks"
+	"gopkg.in/yaml.v2"
+)
+
+// validator is implemented by checks.Check and checks.MessageCheck.
+type validator interface {
+	GetName() string
+	Validate() error
+}
+
+// configKey is a value of the configuration along with its key in the
+// configuration file.
+type configKey struct {
+	// path is the keys leading to the value, e.g. ["test", "extraargs"]. A
+	// custom check is identified by its name, or its index if it has none.
+	path []string
+	v    validator
+	// settings is the struct the configuration of the check is read into.
+	settings interface{}
+}
+
+// keys returns the checks along with their key in the configuration file.
+func (c *Config) keys() []configKey {
+	out := []configKey{
+		{[]string{"buildonly"}, c.BuildOnly.Check(), &c.BuildOnly},
+		{[]string{"gofmt"}, c.Gofmt.Check(), &c.Gofmt},
+		{[]string{"test"}, c.Test.Check(), &c.Test},
+		{[]string{"errcheck"}, c.Errcheck.Check(), &c.Errcheck},
+		{[]string{"goimports"}, c.Goimports.Check(), &c.Goimports},
+		{[]string{"golint"}, c.Golint.Check(), &c.Golint},
+		{[]string{"govet"}, c.Govet.Check(), &c.Govet},
+		{[]string{"testcoverage"}, c.TestCoverage.Check(), &c.TestCoverage},
+		{[]string{"subjectlength"}, c.SubjectLength.Check(), &c.SubjectLength},
+		{[]string{"trailer"}, c.Trailer.Check(), &c.Trailer},
+		{[]string{"nowip"}, c.NoWIP.Check(), &c.NoWIP},
+		{[]string{"signoff"}, c.SignOff.Check(), &c.SignOff},
+	}
+	for i, custom := range c.CustomChecks {
+		// The custom checks are merged by name across the config files.
+		key := custom.Name
+		if key == "" {
+			key = strconv.Itoa(i)
+		}
+		out = append(out, configKey{[]string{"customchecks", key}, custom.Check(), custom})
+	}
+	return out
+}
+
+// configLayer is a configuration file that was loaded.
+type configLayer struct {
+	name    string
+	content []byte
+}
+
+// subtree is a subdirectory with its own config file, which overrides the
+// configuration of the checks for the packages under it.
+type subtree struct {
+	// dir is the absolute directory.
+	dir    string
+	config *Config
+}
+
+// loadSubtrees loads the config files named like name in the subdirectories
+// of the current directory. Each one is based on the config files of its
+// parent directories, up to name.
+func loadSubtrees(name string) ([]*subtree, error) {
+	root, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Base(name)
+	// The files relative to root.
+	files := []string{}
+	var recurse func(dir string)
+	recurse = func(dir string) {
+		entries, _ := ioutil.ReadDir(filepath.Join(root, dir))
+		for _, e := range entries {
+			n := e.Name()
+			if n[0] == '.' || n[0] == '_' || n == "testdata" {
+				continue
+			}
+			if e.IsDir() {
+				recurse(filepath.Join(dir, n))
+			} else if n == base && dir != "" {
+				files = append(files, filepath.Join(dir, n))
+			}
+		}
+	}
+	recurse("")
+	// A parent directory's file is shorter, so it comes first.
+	sort.Stable(byLength(files))
+	out := []*subtree{}
+	for _, f := range files {
+		chain := []string{name}
+		for _, parent := range files {
+			if d := filepath.Dir(parent); d != filepath.Dir(f) && strings.HasPrefix(f, d+string(filepath.Separator)) {
+				chain = append(chain, parent)
+			}
+		}
+		c, _, err := loadFiles(append(chain, f))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &subtree{filepath.Join(root, filepath.Dir(f)), c})
+	}
+	return out, nil
+}
+
+type byLength []string
+
+func (b byLength) Len() int           { return len(b) }
+func (b byLength) Less(i, j int) bool { return len(b[i]) < len(b[j]) }
+func (b byLength) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// configFor returns the configuration of the package in directory dir, the
+// one of the closest subtree containing it.
+func (c *Config) configFor(dir string) *Config {
+	out := c
+	closest := ""
+	for _, s := range c.subtrees {
+		if (dir == s.dir || strings.HasPrefix(dir, s.dir+string(filepath.Separator))) && len(s.dir) > len(closest) {
+			out = s.config
+			closest = s.dir
+		}
+	}
+	return out
+}
+
+// partitionedChecks returns the checks enabled by the profile p, each one
+// running on each package with the configuration of its subtree.
+func (c *Config) partitionedChecks(p *Profile) []checks.Check {
+	names := []string{}
+	seen := map[string]bool{}
+	configs := []*Config{c}
+	for _, s := range c.subtrees {
+		configs = append(configs, s.config)
+	}
+	for _, config := range configs {
+		for _, check := range config.AllChecks() {
+			if !seen[check.GetName()] {
+				seen[check.GetName()] = true
+				names = append(names, check.GetName())
+			}
+		}
+	}
+	out := []checks.Check{}
+	for _, name := range names {
+		check := checks.Partitioned(func(dir string) checks.Check {
+			for _, check := range c.configFor(dir).AllChecks() {
+				if check.GetName() == name && p.enables(name, check.GetRunLevel()) {
+					return check
+				}
+			}
+			return nil
+		})
+		if check != nil {
+			out = append(out, check)
+		}
+	}
+	return out
+}
+
+// maxExtends is the maximum number of files a configuration can be based on,
+// transitively.
+const maxExtends = 10
+
+// load loads the configuration file name into c, after the file it extends,
+// if any. Only the values set in a file override the ones already in c. The
+// custom checks are merged by name.
+//
+// seen is the files extended by name, to detect cycles. It returns the files
+// loaded, the base ones first.
+func (c *Config) load(name string, seen []string) ([]*configLayer, error) {
+	for _, s := range seen {
+		if s == name {
+			return nil, fmt.Errorf("%s: extends cycle: %s -> %s", seen[0], strings.Join(seen, " -> "), name)
+		}
+	}
+	if len(seen) > maxExtends {
+		return nil, fmt.Errorf("%s: extends more than %d files", seen[0], maxExtends)
+	}
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) && len(seen) == 0 {
+			// No config file, use the defaults.
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %s", name, err)
+	}
+	layers := []*configLayer{}
+	header := &struct {
+		Extends string
+	}{}
+	if err := yaml.Unmarshal(content, header); err != nil {
+		return nil, parseError(name, err)
+	}
+	if header.Extends != "" {
+		base, err := resolveExtends(name, header.Extends)
+		if err != nil {
+			return nil, err
+		}
+		if layers, err = c.load(base, append(seen, name)); err != nil {
+			return nil, err
+		}
+	}
+	previous := c.CustomChecks
+	c.CustomChecks = nil
+	// Reject unknown keys, so that a misspelled key is not silently ignored.
+	if err := yaml.UnmarshalStrict(content, c); err != nil {
+		return nil, parseError(name, err)
+	}
+	// The custom checks as written, to only override the values they set.
+	raw := &struct {
+		CustomChecks []yaml.MapSlice
+	}{}
+	if err := yaml.Unmarshal(content, raw); err != nil {
+		return nil, parseError(name, err)
+	}
+	if c.CustomChecks, err = mergeCustomChecks(previous, c.CustomChecks, raw.CustomChecks); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return append(layers, &configLayer{name, content}), nil
+}
+
+// mergeCustomChecks returns the custom checks of a base config, followed by
+// the new ones. A check of override with the same name as a base one is
+// merged into it field by field, using its values as written in raw.
+func mergeCustomChecks(base, override []*checks.CustomCheck, raw []yaml.MapSlice) ([]*checks.CustomCheck, error) {
+	out := append([]*checks.CustomCheck{}, base...)
+outer:
+	for i, o := range override {
+		for j, b := range out {
+			if b.Name != o.Name {
+				continue
+			}
+			// Copy the base check so the base config is not modified.
+			content, err := yaml.Marshal(b)
+			if err != nil {
+				return nil, err
+			}
+			merged := &checks.CustomCheck{}
+			if err := yaml.Unmarshal(content, merged); err != nil {
+				return nil, err
+			}
+			if err := applyOverride(merged, raw[i]); err != nil {
+				return nil, fmt.Errorf("custom check %s: %s", o.Name, err)
+			}
+			out[j] = merged
+			continue outer
+		}
+		out = append(out, o)
+	}
+	return out, nil
+}
+
+// configDirs returns the directories where the base configuration files are
+// looked for: the user then the system pre-commit-go config directories.
+func configDirs() []string {
+	if appData := os.Getenv("APPDATA"); appData != "" {
+		// Windows.
+		return []string{filepath.Join(appData, "pre-commit-go"), filepath.Join(os.Getenv("ProgramData"), "pre-commit-go")}
+	}
+	user := os.Getenv("XDG_CONFIG_HOME")
+	if user == "" {
+		user = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return []string{filepath.Join(user, "pre-commit-go"), "/etc/pre-commit-go"}
+}
+
+// resolveExtends returns the path of the file extended by the configuration
+// file name.
+func resolveExtends(name, extends string) (string, error) {
+	if filepath.IsAbs(extends) {
+		return extends, nil
+	}
+	candidates := []string{filepath.Join(filepath.Dir(name), extends)}
+	for _, d := range configDirs() {
+		candidates = append(candidates, filepath.Join(d, extends))
+	}
+	for _, c := range candidates {
+		if _, err := os.Stat(c); err == nil {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("%s: extends %s: not found in %s", name, extends, strings.Join(candidates, ", "))
+}
+
+// index replaces the name of a custom check in path with its index in the
+// file.
+func (l *configLayer) index(path []string) []string {
+	if len(path) < 2 || path[0] != "customchecks" {
+		return path
+	}
+	if _, err := strconv.Atoi(path[1]); err == nil {
+		return path
+	}
+	c := &struct {
+		CustomChecks []struct {
+			Name string
+		}
+	}{}
+	_ = yaml.Unmarshal(l.content, c)
+	for i, custom := range c.CustomChecks {
+		if custom.Name == path[1] {
+			return append([]string{path[0], strconv.Itoa(i)}, path[2:]...)
+		}
+	}
+	return path
+}
+
+// locate returns the location of the value at path, in the last of the
+// layers setting it, like "pre-commit-go.yml:12". If none sets it, it is the
+// location of its closest parent in the last layer.
+func locate(layers []*configLayer, path []string) string {
+	if len(layers) == 0 {
+		return ""
+	}
+	for i := len(layers) - 1; i >= 0; i-- {
+		if line, exact := findLine(string(layers[i].content), layers[i].index(path)); exact {
+			return layers[i].name + ":" + strconv.Itoa(line)
+		}
+	}
+	last := layers[len(layers)-1]
+	if line, _ := findLine(string(last.content), last.index(path)); line != 0 {
+		return last.name + ":" + strconv.Itoa(line)
+	}
+	return last.name
+}
+
+// validate returns an error listing the invalid values of the configuration,
+// located in the files they come from.
+func (c *Config) validate(layers []*configLayer) error {
+	errs := []string{}
+	add := func(path []string, msg string) {
+		msg = strings.Join(path, ".") + " " + msg
+		if loc := locate(layers, path); loc != "" {
+			msg = loc + ": " + msg
+		}
+		errs = append(errs, msg)
+	}
+	if c.MaxDuration <= 0 {
+		add([]string{"maxduration"}, fmt.Sprintf("must be positive, got %d", c.MaxDuration))
+	}
+	for _, h := range []struct {
+		key      string
+		settings HookSettings
+	}{{"precommit", c.PreCommit}, {"prepush", c.PrePush}, {"commitmsg", c.CommitMsg}} {
+		if h.settings.RunLevel < 0 || h.settings.RunLevel > 3 {
+			add([]string{h.key, "runlevel"}, fmt.Sprintf("must be between 0 and 3, got %d", h.settings.RunLevel))
+		}
+		if h.settings.Profile != "" {
+			if _, err := c.getProfile(h.settings.Profile); err != nil {
+				add([]string{h.key, "profile"}, err.Error())
+			}
+		}
+	}
+	names := map[string]bool{}
+	for _, k := range c.keys() {
+		if err := k.v.Validate(); err != nil {
+			if e, ok := err.(*checks.ConfigError); ok {
+				add(append(k.path, e.Field), e.Message)
+			} else {
+				add(k.path, err.Error())
+			}
+			continue
+		}
+		if names[k.v.GetName()] {
+			add(append(k.path, "name"), fmt.Sprintf("%q is used by another check", k.v.GetName()))
+		}
+		names[k.v.GetName()] = true
+	}
+	c.validateProfiles(add)
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// yamlLineRe matches the errors returned by the yaml package, e.g.
+// "line 3: field foo not found in type checks.Test".
+var yamlLineRe = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlUnknownRe matches the errors about a misspelled key.
+var yamlUnknownRe = regexp.MustCompile(`field (\S+) not found in type \S+`)
+
+// parseError converts an error returned by yaml.UnmarshalStrict() for the
+// configuration file name into errors prefixed with "file:line:".
+func parseError(name string, err error) error {
+	msgs := []string{err.Error()}
+	if t, ok := err.(*yaml.TypeError); ok {
+		msgs = t.Errors
+	}
+	out := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		msg = yamlUnknownRe.ReplaceAllString(msg, "unknown key $1")
+		if m := yamlLineRe.FindStringSubmatch(msg); m != nil {
+			out = append(out, fmt.Sprintf("%s:%s: %s", name, m[1], m[2]))
+		} else {
+			out = append(out, fmt.Sprintf("%s: %s", name, strings.TrimPrefix(msg, "yaml: ")))
+		}
+	}
+	return errors.New(strings.Join(out, "\n"))
+}
+
+// findLine returns the 1-based line of the value at path in the YAML document
+// content, or of its closest parent found, and true if the value itself was
+// found. It returns 0 if none is found.
+//
+// A number in path is the index of an item in a list. It only understands
+// the block style, which is what writeconfig writes.
+func findLine(content string, path []string) (int, bool) {
+	lines := strings.Split(content, "\n")
+	found := 0
+	start := 0
+	parentIndent := -1
+	for _, key := range path {
+		index, err := strconv.Atoi(key)
+		isIndex := err == nil
+		match := -1
+		childIndent := -1
+		count := 0
+		for i := start; i < len(lines); i++ {
+			text := strings.TrimLeft(lines[i], " ")
+			indent := len(lines[i]) - len(text)
+			if text == "" || text[0] == '#' {
+				continue
+			}
+			// The items of a list may be at the same indentation as its key.
+			if indent < parentIndent || (indent == parentIndent && !(isIndex && text[0] == '-')) {
+				break
+			}
+			if childIndent == -1 {
+				childIndent = indent
+			}
+			if indent != childIndent {
+				continue
+			}
+			if isIndex {
+				if text[0] == '-' {
+					if count == index {
+						match = i
+						break
+					}
+					count++
+				}
+			} else if strings.HasPrefix(text, key+":") {
+				match = i
+				break
+			}
+		}
+		if match == -1 {
+			return found, false
+		}
+		found = match + 1
+		text := strings.TrimLeft(lines[match], " ")
+		parentIndent = len(lines[match]) - len(text)
+		start = match + 1
+		if isIndex {
+			// The first key of the item is on the same line as the dash; look
+			// at it as if it was on its own line.
+			lines = append([]string{}, lines...)
+			lines[match] = strings.Repeat(" ", parentIndent) + " " + text[1:]
+			start = match
+		}
+	}
+	return found, true
+}
+
+// validateConfig loads the configuration file name and reports if it is
+// valid.
+func validateConfig(name string) error {
+	if _, err := getConfig(name); err != nil {
+		return err
+	}
+	if _, err := os.Stat(name); os.IsNotExist(err) {
+		fmt.Printf("%s not found, the defaults are used\n", name)
+		return nil
+	}
+	fmt.Printf("%s is valid\n", name)
+	return nil
+}
+
+// origins returns the file setting each value of the configuration, keyed by
+// its path like "test.extraargs". The values of a custom check are keyed by its
+// name like "customchecks.foo.command" and the check itself, by the file
+// defining it first, like "customchecks.foo".
+func origins(layers []*configLayer) map[string]string {
+	out := map[string]string{}
+	var walk func(m yaml.MapSlice, path []string, name string)
+	walk = func(m yaml.MapSlice, path []string, name string) {
+		for _, item := range m {
+			p := append(append([]string{}, path...), fmt.Sprint(item.Key))
+			switch v := item.Value.(type) {
+			case yaml.MapSlice:
+				walk(v, p, name)
+			case []interface{}:
+				if len(p) == 1 && p[0] == "customchecks" {
+					for _, c := range v {
+						m, ok := c.(yaml.MapSlice)
+						if !ok {
+							continue
+						}
+						check := ""
+						for _, i := range m {
+							if fmt.Sprint(i.Key) == "name" {
+								check = "customchecks." + fmt.Sprint(i.Value)
+							}
+						}
+						if check == "" {
+							continue
+						}
+						if _, ok := out[check]; !ok {
+							out[check] = name
+						}
+						for _, i := range m {
+							out[check+"."+fmt.Sprint(i.Key)] = name
+						}
+					}
+					continue
+				}
+				out[strings.Join(p, ".")] = name
+			default:
+				out[strings.Join(p, ".")] = name
+			}
+		}
+	}
+	for _, l := range layers {
+		m := yaml.MapSlice{}
+		if err := yaml.Unmarshal(l.content, &m); err == nil {
+			walk(m, nil, l.name)
+		}
+	}
+	return out
+}
+
+// showConfig prints the configuration file name or, when resolved is true,
+// the configuration resulting from it and the files it extends, annotated with
+// the origin of each value.
+func showConfig(w io.Writer, name string, resolved bool) error {
+	config, layers, err := loadConfig(name)
+	if err != nil {
+		return err
+	}
+	if !resolved {
+		if len(layers) == 0 {
+			return fmt.Errorf("%s not found, the defaults are used", name)
+		}
+		_, err := w.Write(layers[len(layers)-1].content)
+		return err
+	}
+	content, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	m := yaml.MapSlice{}
+	if err := yaml.Unmarshal(content, &m); err != nil {
+		return err
+	}
+	o := origins(layers)
+	origin := func(path []string) string {
+		for i := len(path); i > 0; i-- {
+			if n, ok := o[strings.Join(path[:i], ".")]; ok {
+				return n
+			}
+		}
+		return "default"
+	}
+	var printMap func(m yaml.MapSlice, path []string, indent, first string)
+	printMap = func(m yaml.MapSlice, path []string, indent, first string) {
+		for i, item := range m {
+			prefix := indent
+			if i == 0 {
+				prefix = first
+			}
+			key := fmt.Sprint(item.Key)
+			p := append(append([]string{}, path...), key)
+			if sub, ok := item.Value.(yaml.MapSlice); ok {
+				fmt.Fprintf(w, "%s%s:\n", prefix, key)
+				printMap(sub, p, indent+"  ", indent+"  ")
+				continue
+			}
+			if list, ok := item.Value.([]interface{}); ok && key == "customchecks" {
+				fmt.Fprintf(w, "%s%s:\n", prefix, key)
+				for _, c := range list {
+					sub, _ := c.(yaml.MapSlice)
+					name := ""
+					for _, i := range sub {
+						if fmt.Sprint(i.Key) == "name" {
+							name = fmt.Sprint(i.Value)
+						}
+					}
+					printMap(sub, []string{key, name}, indent+"  ", indent+"- ")
+				}
+				continue
+			}
+			value, _ := yaml.Marshal(item.Value)
+			lines := strings.Split(strings.TrimRight(string(value), "\n"), "\n")
+			if len(lines) == 1 && !strings.HasPrefix(lines[0], "- ") {
+				fmt.Fprintf(w, "%s%s: %s  # %s\n", prefix, key, lines[0], origin(p))
+				continue
+			}
+			fmt.Fprintf(w, "%s%s:  # %s\n", prefix, key, origin(p))
+			for _, line := range lines {
+				fmt.Fprintf(w, "%s%s\n", indent, line)
+			}
+		}
+	}
+	printMap(m, nil, "", "")
+	return nil
+}
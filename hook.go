@@ -0,0 +1,514 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/maruel/pre-commit-go/checks"
+)
+
+// hookTypes lists the git hooks supported by 'pre-commit-go hook'.
+var hookTypes = []string{"pre-commit", "pre-push", "commit-msg"}
+
+// zeroSHA1 is what git sends to the pre-push hook for a ref that doesn't
+// exist.
+const zeroSHA1 = "0000000000000000000000000000000000000000"
+
+// hookMarker identifies the git hooks generated by pre-commit-go.
+const hookMarker = `This file was generated by tool "pre-commit-go"`
+
+// chainedSuffix is appended to the name of a git hook that was installed
+// before pre-commit-go. 'pre-commit-go hook' runs it first and uninstall puts
+// it back.
+const chainedSuffix = ".pre-commit-go.orig"
+
+// hookScript returns the git hook installed as .git/hooks/<hookType>. All the
+// logic lives in 'pre-commit-go hook' so that it doesn't depend on bash.
+func hookScript(hookType string, chained bool) []byte {
+	out := "#!/bin/sh\n# WARNING: " + hookMarker + "\n"
+	if chained {
+		out += "# The previous hook was moved to " + hookType + chainedSuffix + " and is run\n# first. 'pre-commit-go uninstall' restores it.\n"
+	}
+	return []byte(out + "exec pre-commit-go hook " + hookType + " \"$@\"\n")
+}
+
+// isOurHook returns true if the file p was generated by pre-commit-go.
+func isOurHook(p string) bool {
+	content, err := ioutil.ReadFile(p)
+	return err == nil && bytes.Contains(content, []byte(hookMarker))
+}
+
+// installHook installs the git hook hookType in hooksDir. A hook from another
+// tool is moved aside and chained instead of being overwritten.
+func installHook(hooksDir, hookType string) error {
+	p := filepath.Join(hooksDir, hookType)
+	orig := p + chainedSuffix
+	if _, err := os.Lstat(p); err == nil && !isOurHook(p) {
+		if _, err := os.Lstat(orig); err == nil {
+			return fmt.Errorf("%s was not generated by pre-commit-go and %s already exists; remove one of them", p, orig)
+		}
+		if err := os.Rename(p, orig); err != nil {
+			return err
+		}
+		fmt.Printf("moved the existing hook to %s; it will be run first\n", orig)
+	}
+	_, err := os.Lstat(orig)
+	chained := err == nil
+	// Always remove the hook first if it exists, in case it's a symlink.
+	_ = os.Remove(p)
+	return ioutil.WriteFile(p, hookScript(hookType, chained), 0766)
+}
+
+// uninstallHook removes the git hook hookType from hooksDir and puts back the
+// hook it replaced, if any.
+func uninstallHook(hooksDir, hookType string) error {
+	p := filepath.Join(hooksDir, hookType)
+	orig := p + chainedSuffix
+	_, err := os.Lstat(orig)
+	hasOrig := err == nil
+	if _, err := os.Lstat(p); err == nil {
+		if !isOurHook(p) {
+			if hasOrig {
+				return fmt.Errorf("%s was not generated by pre-commit-go; not restoring %s", p, orig)
+			}
+			log.Printf("%s was not generated by pre-commit-go; leaving it alone", p)
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	}
+	if hasOrig {
+		return os.Rename(orig, p)
+	}
+	return nil
+}
+
+// runChained runs the git hook that was installed before pre-commit-go, if
+// any, with the same arguments and stdin.
+func runChained(hookType string, args []string, stdin io.Reader) error {
+	gitDir, err := captureAbs("git", "rev-parse", "--git-dir")
+	if err != nil {
+		return fmt.Errorf("failed to find .git dir: %s", err)
+	}
+	p := filepath.Join(gitDir, "hooks", hookType+chainedSuffix)
+	if stat, err := os.Stat(p); err != nil || stat.Mode()&0111 == 0 {
+		// Like git, ignore a hook that is not executable.
+		return nil
+	}
+	log.Printf("running %s", p)
+	c := exec.Command(p, args...)
+	c.Stdin = stdin
+	c.Stdout = os.Stderr
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("%s failed: %s", p, err)
+	}
+	return nil
+}
+
+// stashStateFile is the file, relative to the .git directory, that records
+// the stash created by a running hook. It is removed once the tree is
+// restored, so its presence means a previous hook run was interrupted.
+const stashStateFile = "pre-commit-go.stash"
+
+// stasher stashes the unstaged changes of the working tree and restores them
+// exactly once, whether the checks completed or the
+// process was interrupted.
+type stasher struct {
+	lock      sync.Mutex
+	statePath string
+	stash     string
+	restored  bool
+}
+
+// save stashes the working tree, keeping only the content of the index. It
+// returns false if there was nothing to stash.
+func (s *stasher) save() (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	oldStash, _ := runGit("rev-parse", "-q", "--verify", "refs/stash")
+	if _, err := runGit("stash", "save", "-q", "--keep-index"); err != nil {
+		return false, err
+	}
+	newStash, _ := runGit("rev-parse", "-q", "--verify", "refs/stash")
+	if oldStash == newStash {
+		// If there were no changes (e.g., '--amend' or '--allow-empty') then
+		// nothing was stashed.
+		s.restored = true
+		return false, nil
+	}
+	s.stash = newStash
+	if err := ioutil.WriteFile(s.statePath, []byte(newStash+"\n"), 0666); err != nil {
+		return true, fmt.Errorf("failed to write %s: %s", s.statePath, err)
+	}
+	return true, nil
+}
+
+// restore puts back the working tree as it was before save() was called.
+func (s *stasher) restore() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.restored || s.stash == "" {
+		return nil
+	}
+	s.restored = true
+	return restoreStash(s.statePath, s.stash)
+}
+
+// restoreStash resets the tree and reapplies the stash, then drops it and
+// deletes the state file.
+func restoreStash(statePath, stash string) error {
+	if _, err := runGit("reset", "--hard", "-q"); err != nil {
+		return err
+	}
+	if _, err := runGit("stash", "apply", "--index", "-q", stash); err != nil {
+		return fmt.Errorf("%s\nrun 'pre-commit-go hook -recover' to retry", err)
+	}
+	// Find the stash entry to drop it. It's usually stash@{0} but the user may
+	// have stashed something else since an interrupted run.
+	out, _ := runGit("stash", "list", "--format=%H")
+	for i, line := range strings.Split(out, "\n") {
+		if line == stash {
+			if _, err := runGit("stash", "drop", "-q", fmt.Sprintf("stash@{%d}", i)); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// recoverHook restores the working tree after an interrupted hook run.
+func recoverHook() error {
+	gitDir, err := captureAbs("git", "rev-parse", "--git-dir")
+	if err != nil {
+		return fmt.Errorf("failed to find .git dir: %s", err)
+	}
+	statePath := filepath.Join(gitDir, stashStateFile)
+	content, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return errors.New("nothing to recover")
+	}
+	if err != nil {
+		return err
+	}
+	stash := strings.TrimSpace(string(content))
+	if _, err := runGit("rev-parse", "-q", "--verify", stash+"^{commit}"); err != nil {
+		return fmt.Errorf("stash %s recorded in %s is gone", stash, statePath)
+	}
+	if err := restoreStash(statePath, stash); err != nil {
+		return err
+	}
+	fmt.Printf("restored the working tree from stash %s\n", stash)
+	return nil
+}
+
+// runIsolated runs the enabled checks on the content of the index in a
+// temporary checkout, leaving the working tree and untracked files untouched.
+func runIsolated(ctx context.Context, name string, opts *options, change *checks.Change) error {
+	c, err := newIndexCheckout()
+	if err != nil {
+		return err
+	}
+	err = run(ctx, name, opts, change)
+	if err2 := c.close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// runRev runs the enabled checks on revision tip in a temporary checkout,
+// only looking at the files modified since base.
+func runRev(ctx context.Context, name string, opts *options, base, tip string) error {
+	change, err := getRangeChange(base, tip)
+	if err != nil {
+		return err
+	}
+	return inRev(tip, func() error {
+		return run(ctx, name, opts, change)
+	})
+}
+
+// inRev calls f in a temporary checkout of revision rev.
+func inRev(rev string, f func() error) error {
+	c, err := newRevCheckout(rev)
+	if err != nil {
+		return err
+	}
+	err = f()
+	if err2 := c.close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// hook runs the checks for the git hook hookType. args are the arguments git
+// passed to the hook. If opts.profile is empty, the profile configured
+// for this hook is used.
+func hook(ctx context.Context, name, hookType string, args []string, opts *options, isolated bool, diffRev string) error {
+	// Redirect output to stderr, like git expects from hooks.
+	os.Stdout = os.Stderr
+
+	config, err := getConfig(name)
+	if err != nil {
+		return err
+	}
+	settings := config.hookSettings(hookType)
+	if settings == nil {
+		return fmt.Errorf("unsupported hook %q; supported hooks are %s", hookType, strings.Join(hookTypes, ", "))
+	}
+	if opts.profile == "" {
+		o := *opts
+		o.profile = settings.profile()
+		opts = &o
+	}
+	// pre-push is the only hook that receives data on stdin, it has to be
+	// read first so that both the chained hook and the checks get it.
+	var stdin []byte
+	if hookType == "pre-push" {
+		if stdin, err = ioutil.ReadAll(os.Stdin); err != nil {
+			return err
+		}
+	}
+	if err := runChained(hookType, args, bytes.NewReader(stdin)); err != nil {
+		return err
+	}
+	switch hookType {
+	case "pre-push":
+		if len(args) == 0 {
+			return errors.New("pre-push requires the remote name as argument")
+		}
+		return hookPrePush(ctx, name, opts, args[0], bytes.NewReader(stdin))
+	case "commit-msg":
+		if len(args) == 0 {
+			return errors.New("commit-msg requires the commit message file as argument")
+		}
+		return hookCommitMsg(name, opts.profile, args[0])
+	default:
+		return hookPreCommit(ctx, name, opts, isolated, diffRev)
+	}
+}
+
+// hookCommitMsg runs the enabled commit message checks on the message in
+// file msgPath.
+func hookCommitMsg(name, profile, msgPath string) error {
+	m, err := readCommitMessage(msgPath)
+	if err != nil {
+		return err
+	}
+	config, err := getConfig(name)
+	if err != nil {
+		return err
+	}
+	enabled, err := config.EnabledMessageChecks(profile)
+	if err != nil {
+		return err
+	}
+	failed := false
+	for _, c := range enabled {
+		if err := c.RunMessage(m); err != nil {
+			fmt.Printf("%s: %s\n", c.GetName(), err)
+			failed = true
+		}
+	}
+	if failed {
+		return fmt.Errorf("commit message checks failed; the message was saved in %s", msgPath)
+	}
+	return nil
+}
+
+// readCommitMessage reads the commit message being committed, stripping the
+// comments like git does, along with the branch and the committer identity.
+func readCommitMessage(msgPath string) (*checks.CommitMessage, error) {
+	content, err := ioutil.ReadFile(msgPath)
+	if err != nil {
+		return nil, err
+	}
+	commentChar, _ := runGit("config", "core.commentChar")
+	if commentChar == "" || commentChar == "auto" {
+		commentChar = "#"
+	}
+	lines := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		// Everything below the scissors line of 'git commit -v' is ignored.
+		if strings.HasPrefix(line, commentChar+" ") && strings.Contains(line, ">8") {
+			break
+		}
+		if !strings.HasPrefix(line, commentChar) {
+			lines = append(lines, strings.TrimRight(line, " \t\r"))
+		}
+	}
+	m := &checks.CommitMessage{Message: strings.TrimSpace(strings.Join(lines, "\n"))}
+	m.Branch, _ = runGit("symbolic-ref", "-q", "--short", "HEAD")
+	// The identity is "Name <email> timestamp timezone".
+	if ident, err := runGit("var", "GIT_COMMITTER_IDENT"); err == nil {
+		if i := strings.LastIndex(ident, ">"); i != -1 {
+			m.Committer = ident[:i+1]
+		}
+	}
+	return m, nil
+}
+
+// hookPrePush runs the checks on each ref being pushed, as read from r in the
+// format git sends to the pre-push hook. Each tip is checked in a temporary
+// checkout and only the files modified by the commits being pushed are looked
+// at.
+func hookPrePush(ctx context.Context, name string, opts *options, remote string, r io.Reader) error {
+	failed := []string{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		// <local ref> SP <local sha1> SP <remote ref> SP <remote sha1>
+		items := strings.Fields(s.Text())
+		if len(items) != 4 {
+			return fmt.Errorf("unexpected pre-push hook input: %q", s.Text())
+		}
+		localRef, local, remoteSHA1 := items[0], items[1], items[3]
+		if local == zeroSHA1 {
+			// The remote ref is being deleted.
+			continue
+		}
+		base, err := pushBase(remote, local, remoteSHA1)
+		if err != nil {
+			return err
+		}
+		if base == "" {
+			log.Printf("%s: no new commit", localRef)
+			continue
+		}
+		log.Printf("%s: checking %s..%s", localRef, base, local)
+		if err := runRev(ctx, name, opts, base, local); err != nil {
+			fmt.Printf("%s: %s\n", localRef, err)
+			failed = append(failed, localRef)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("checks failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// pushBase returns the commit to diff local against to find the files
+// modified by the commits being pushed, or "" if there is no new commit.
+func pushBase(remote, local, remoteSHA1 string) (string, error) {
+	if remoteSHA1 == local {
+		return "", nil
+	}
+	if remoteSHA1 != zeroSHA1 {
+		if _, err := runGit("cat-file", "-e", remoteSHA1+"^{commit}"); err == nil {
+			return remoteSHA1, nil
+		}
+	}
+	// It's a new ref or the remote has commits that were not fetched. Look at
+	// the commits not present on the remote instead.
+	out, err := runGit("rev-list", "--reverse", local, "--not", "--remotes="+remote)
+	if err != nil {
+		return "", err
+	}
+	if out == "" {
+		return "", nil
+	}
+	first := strings.SplitN(out, "\n", 2)[0]
+	if parent, err := runGit("rev-parse", "-q", "--verify", first+"^"); err == nil {
+		return parent, nil
+	}
+	return emptyTree, nil
+}
+
+// hookPreCommit runs the enabled checks on the content of the index.
+//
+// Only the files modified compared to diffRev are checked; it defaults to the
+// staged changes when empty.
+//
+// Unless isolated is set, the unstaged changes are stashed during the run and
+// restored afterward, including when the process is interrupted. When
+// isolated is set, the index is materialized in a temporary directory
+// instead.
+func hookPreCommit(ctx context.Context, name string, opts *options, isolated bool, diffRev string) error {
+	if diffRev == "" {
+		diffRev = headRev()
+	}
+	change, err := getChange(diffRev, true)
+	if err != nil {
+		return err
+	}
+
+	config, err := getConfig(name)
+	if err != nil {
+		return err
+	}
+	if isolated || config.Isolated {
+		// If nothing is staged (e.g., '--amend' or '--allow-empty'), skip
+		// everything like the stash mode does.
+		if _, code, _ := capture("git", "diff", "--cached", "--quiet"); code == 0 {
+			return nil
+		}
+		return runIsolated(ctx, name, opts, change)
+	}
+
+	gitDir, err := captureAbs("git", "rev-parse", "--git-dir")
+	if err != nil {
+		return fmt.Errorf("failed to find .git dir: %s", err)
+	}
+	statePath := filepath.Join(gitDir, stashStateFile)
+	if _, err := os.Stat(statePath); err == nil {
+		return fmt.Errorf("a previous run was interrupted, run 'pre-commit-go hook -recover' first")
+	}
+
+	// Ensure everything is either tracked or ignored. This is because git stash
+	// doesn't stash untracked files.
+	untracked, err := runGit("ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return err
+	}
+	if untracked != "" {
+		return fmt.Errorf("this check refuses to run if there is an untracked file. Either track\nit or put it in the .gitignore or your global exclusion list:\n%s", untracked)
+	}
+
+	// An interruption cancels ctx, which kills the checks; the tree is then
+	// restored below as usual.
+	s := &stasher{statePath: statePath}
+	stashed, err := s.save()
+	if err != nil {
+		if stashed {
+			if err2 := s.restore(); err2 != nil {
+				return fmt.Errorf("%s\n%s", err, err2)
+			}
+		}
+		return err
+	}
+	if !stashed {
+		// Presumably the tests passed on the previous commit, so there is no
+		// need to re-run them.
+		return nil
+	}
+	err = run(ctx, name, opts, change)
+	if err2 := s.restore(); err2 != nil {
+		if err == nil {
+			return err2
+		}
+		return fmt.Errorf("%s\n%s", err, err2)
+	}
+	return err
+}
@@ -7,6 +7,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -15,6 +16,8 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"text/template"
 	"time"
@@ -25,106 +28,150 @@ import (
 
 // Globals
 
-// TODO(maruel): Reimplement this in go instead of processing it in bash.
-var preCommitHook = []byte(`#!/bin/sh
-# Copyright 2015 Marc-Antoine Ruel. All rights reserved.
-# Use of this source code is governed under the Apache License, Version 2.0
-# that can be found in the LICENSE file.
-
-# pre-commit git hook to runs presubmit.py on the tree with unstaged changes
-# removed.
-#
-# WARNING: This file was generated by tool "pre-commit-go"
-
-
-# Redirect output to stderr.
-exec 1>&2
-
-
-run_checks() {
-  # Ensure everything is either tracked or ignored. This is because git stash
-  # doesn't stash untracked files.
-  untracked="$(git ls-files --others --exclude-standard)"
-  if [ "$untracked" != "" ]; then
-    echo "This check refuses to run if there is an untracked file. Either track"
-    echo "it or put it in the .gitignore or your global exclusion list:"
-    echo "$untracked"
-    return 1
-  fi
-
-  # Run the presubmit check.
-  pre-commit-go run
-  result=$?
-  if [ $result != 0 ]; then
-    return $result
-  fi
-}
-
-
-if git rev-parse --verify HEAD >/dev/null 2>&1
-then
-  against=HEAD
-else
-  # Initial commit: diff against an empty tree object
-  against=4b825dc642cb6eb9a060e54bf8d69288fbee4904
-fi
-
-
-# Use a precise "stash, run checks, unstash" to ensure that the check is
-# properly run on the data in the index.
-# Inspired from
-# http://stackoverflow.com/questions/20479794/how-do-i-properly-git-stash-pop-in-pre-commit-hooks-to-get-a-clean-working-tree
-# First, stash index and work dir, keeping only the to-be-committed changes in
-# the working directory.
-old_stash=$(git rev-parse -q --verify refs/stash)
-git stash save -q --keep-index
-new_stash=$(git rev-parse -q --verify refs/stash)
-
-# If there were no changes (e.g., '--amend' or '--allow-empty') then nothing was
-# stashed, and we should skip everything, including the tests themselves.
-# (Presumably the tests passed on the previous commit, so there is no need to
-# re-run them.)
-if [ "$old_stash" = "$new_stash" ]; then
-  exit 0
-fi
-
-run_checks
-result=$?
-
-# Restore changes.
-git reset --hard -q && git stash apply --index -q && git stash drop -q
-exit $result
-`)
-
 var helpText = template.Must(template.New("help").Parse(`pre-commit-go: runs pre-commit checks on Go projects, fast.
 
 Supported commands are:
   help        - this page
-  install     - runs 'prereq' then installs the git commit hook as
-                .git/hooks/pre-commit
+  baseline    - runs the enabled checks on the whole tree and records the
+                findings of the lint and format checks in
+                pre-commit-go.baseline.json; 'run' then only fails on the
+                findings not in it
+  cache clean - deletes the results of the checks that passed, which are
+                otherwise reused when the sources didn't change; see -nocache
+  config show - prints the config file; with -resolved, the config resulting
+                from it and the files it extends, with the origin of each
+                value
+  hook        - runs the checks for a git hook, 'pre-commit' by default:
+                - pre-commit runs the checks on the content of the index,
+                  stashing the unstaged changes during the run. Use -recover
+                  to restore the tree after an interrupted run and -isolated
+                  to run in a temporary checkout instead of stashing
+                - pre-push runs the checks on the commits being pushed
+                - commit-msg runs the commit message checks
+                This is what the installed git hooks run.
+  install     - runs 'prereq' then installs the git hooks listed in -hooks,
+                by default .git/hooks/pre-commit. An existing hook from
+                another tool is kept and run first
   prereq      - installs prerequisites, e.g.: errcheck, golint, goimports,
                 govet, etc as applicable for the enabled checks
   installrun  - runs 'prereq', 'install' then 'run'
-  run         - runs all enabled checks
+  run         - runs all enabled checks; use -failfast to stop at the first
+                failure. With -isolated, on the content of the index in a
+                temporary checkout. With -diff, only on the files and
+                packages modified since this revision; without it, the whole
+                tree is checked, which is what CI should use. With -range, on
+                each commit of a revision range (or only its tip with
+                -tiponly), reporting the commit introducing each failure.
+                Use -format json for a machine readable report, -junit and
+                -sarif to also write JUnit XML and SARIF reports
+  stats       - prints how long each check and the slowest test packages
+                took in the previous runs, and whether they get slower
+  uninstall   - removes the git hooks installed by pre-commit-go and restores
+                the ones they replaced
+  validate    - loads the config and reports the misspelled keys and the
+                invalid values, for CI
+  watch       - watches the tree and runs the enabled checks on the packages
+                affected by each modification, printing a status line
   writeconfig - writes (or rewrite) a pre-commit-go.yml
 
 When executed without command, it does the equivalent of 'installrun'.
 Supported flags are:
 {{.Usage}}
-Supported checks and their runlevel:
+Supported checks and their runlevel, 0 meaning disabled:
   Native checks that only depends on the stdlib:{{range .NativeChecks}}
     - {{printf "%-*s %d" $.Max .GetName .GetRunLevel}} : {{.GetDescription}}{{end}}
 
   Checks that have prerequisites (which will be automatically installed):{{range .OtherChecks}}
     - {{printf "%-*s %d" $.Max .GetName .GetRunLevel}} : {{.GetDescription}}{{end}}
 
+  Commit message checks, run by the commit-msg hook:{{range .MessageChecks}}
+    - {{printf "%-*s %d" $.Max .GetName .GetRunLevel}} : {{.GetDescription}}{{end}}
+{{if .Profiles}}
+Profiles of the config, in addition to the run levels 0 to 3:{{range .Profiles}}
+  - {{.}}{{end}}
+{{end}}
 No check ever modify any file.
 `))
 
 // Configuration.
 
+// options are the command line flags that control how the checks are run.
+type options struct {
+	// profile selects the checks to run, see Config.EnabledChecks(). It is a
+	// profile of the config or a run level like "2".
+	profile string
+	// failFast cancels the remaining checks as soon as one fails, in addition
+	// to Config.FailFast.
+	failFast bool
+	// format is the output format of run, "text" or "json".
+	format string
+	// junit is the path of the JUnit XML report written by run, if any.
+	junit string
+	// sarif is the path of the SARIF report written by run, if any.
+	sarif string
+	// cacheDir is the directory of the cache of the checks that passed. Empty
+	// disables the cache.
+	cacheDir string
+	// timings is the file where the durations of the checks are recorded.
+	// Empty disables the recording.
+	timings string
+	// baseline is the known findings that do not fail the checks, if any.
+	baseline *baseline
+	// shrinkBaseline removes from the baseline file the known findings that
+	// are fixed, when the checks run on the whole tree.
+	shrinkBaseline bool
+	// affectedOnly skips the checks, and the partitions of a check, that
+	// don't look at any package affected by the change.
+	affectedOnly bool
+}
+
+// HookSettings is the configuration of a git hook.
+type HookSettings struct {
+	// Run level used when the checks are run by this hook.
+	RunLevel int
+	// Profile used when the checks are run by this hook, instead of RunLevel.
+	Profile string `yaml:",omitempty"`
+}
+
+// profile returns the name of the profile used by the hook.
+func (h *HookSettings) profile() string {
+	if h.Profile != "" {
+		return h.Profile
+	}
+	return strconv.Itoa(h.RunLevel)
+}
+
+// Profile is a named set of checks, selected with -profile or by a git hook.
+type Profile struct {
+	// RunLevel enables the checks whose run level is lower or equal, like the
+	// built-in profiles do.
+	RunLevel int `yaml:",omitempty"`
+	// Checks are the names of the checks enabled regardless of their run
+	// level.
+	Checks []string `yaml:",omitempty"`
+	// Overrides are the settings of the checks when run with this profile,
+	// keyed by check name, e.g. a higher minimum coverage on CI.
+	Overrides map[string]yaml.MapSlice `yaml:",omitempty"`
+}
+
 type Config struct {
+	// Extends is a config file this one is based on. Its values are overridden
+	// by the ones set in this file. A relative path is relative to the
+	// directory of this file, or to the user or system pre-commit-go config
+	// directory. See configDirs().
+	Extends string `yaml:",omitempty"`
+
 	MaxDuration int // In seconds.
+	// Isolated runs the checks in a temporary checkout of the index instead of
+	// stashing the unstaged changes in the working tree.
+	Isolated bool
+	// FailFast cancels the remaining checks as soon as one fails.
+	FailFast bool
+
+	// Git hooks.
+	PreCommit HookSettings
+	PrePush   HookSettings
+	CommitMsg HookSettings
 
 	// Native checks.
 	BuildOnly checks.BuildOnly
@@ -140,15 +187,69 @@ type Config struct {
 
 	// User configurable presubmit checks.
 	CustomChecks []*checks.CustomCheck
+
+	// Profiles are the named sets of checks, in addition to the run levels "0"
+	// to "3". See Profile.
+	Profiles map[string]*Profile `yaml:",omitempty"`
+
+	// Commit message checks.
+	SubjectLength checks.SubjectLength
+	Trailer       checks.Trailer
+	NoWIP         checks.NoWIP
+	SignOff       checks.SignOff
+
+	// subtrees are the subdirectories with their own config file.
+	subtrees []*subtree
 }
 
 // getConfig() returns a Config with defaults set then loads the config from
-// file "name".
-func getConfig(name string) *Config {
-	config := &Config{MaxDuration: 120, CustomChecks: []*checks.CustomCheck{}}
+// file "name", along with the files it extends.
+func getConfig(name string) (*Config, error) {
+	config, _, err := loadConfig(name)
+	return config, err
+}
+
+// getConfigOrDefaults is like getConfig() except that it prints the error and
+// returns the default configuration when the config file can't be loaded, so
+// that the commands not running checks still work with a broken file.
+func getConfigOrDefaults(name string) *Config {
+	config, err := getConfig(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pre-commit-go: %s; using the defaults\n", err)
+		config, _, _ = loadFiles(nil)
+	}
+	return config
+}
+
+// loadConfig is like getConfig() and also returns the files loaded, the
+// base ones first.
+func loadConfig(name string) (*Config, []*configLayer, error) {
+	config, layers, err := loadFiles([]string{name})
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.subtrees, err = loadSubtrees(name); err != nil {
+		return nil, nil, err
+	}
+	return config, layers, nil
+}
+
+// loadFiles returns a Config with defaults set then loads the config files
+// names, each one overriding the values set by the previous ones.
+func loadFiles(names []string) (*Config, []*configLayer, error) {
+	config := &Config{
+		MaxDuration:  120,
+		PreCommit:    HookSettings{RunLevel: 1},
+		PrePush:      HookSettings{RunLevel: 3},
+		CommitMsg:    HookSettings{RunLevel: 1},
+		CustomChecks: []*checks.CustomCheck{},
+	}
 	for _, c := range config.AllChecks() {
 		c.ResetDefault()
 	}
+	for _, c := range config.AllMessageChecks() {
+		c.ResetDefault()
+	}
 
 	// TODO(maruel): Settle on config format. Options:
 	// - json (encoding/json); does not require anything except stdlib but
@@ -160,13 +261,74 @@ func getConfig(name string) *Config {
 	//
 	// Side effect: either it would slow down go get .../pre-commit-go or we'd
 	// have to use godep and periodically sync.
-	content, err := ioutil.ReadFile(name)
-	if err == nil {
-		if err2 := yaml.Unmarshal(content, config); err2 != nil {
-			log.Printf("failed to parse %s: %s", name, err2)
+	layers := []*configLayer{}
+	for _, name := range names {
+		l, err := config.load(name, nil)
+		if err != nil {
+			return nil, nil, err
 		}
+		layers = append(layers, l...)
+	}
+	if err := config.validate(layers); err != nil {
+		return nil, nil, err
+	}
+	if err := config.validateDependencies(); err != nil {
+		return nil, nil, fmt.Errorf("invalid %s: %s", names[len(names)-1], err)
+	}
+	return config, layers, nil
+}
+
+// validateDependencies ensures that DependsOn only references existing checks
+// and that there is no cycle.
+func (c *Config) validateDependencies() error {
+	byName := map[string]checks.Check{}
+	for _, check := range c.AllChecks() {
+		byName[check.GetName()] = check
+	}
+	// 0 is unvisited, 1 is being visited, 2 is done.
+	state := map[string]int{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		path = append(path, name)
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("dependency cycle: %s", strings.Join(path, " -> "))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, dep := range byName[name].GetDependsOn() {
+			if _, ok := byName[dep]; !ok {
+				return fmt.Errorf("check %s depends on unknown check %q", name, dep)
+			}
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		return nil
+	}
+	for _, check := range c.AllChecks() {
+		if err := visit(check.GetName(), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hookSettings returns the settings of the git hook hookType or nil if it is
+// not supported.
+func (c *Config) hookSettings(hookType string) *HookSettings {
+	switch hookType {
+	case "pre-commit":
+		return &c.PreCommit
+	case "pre-push":
+		return &c.PrePush
+	case "commit-msg":
+		return &c.CommitMsg
+	default:
+		return nil
 	}
-	return config
 }
 
 // AllChecks returns all the checks.
@@ -187,32 +349,87 @@ func (c *Config) AllChecks() []checks.Check {
 	return out
 }
 
-// EnabledChecks returns all the checks enabled at this run level.
-func (c *Config) EnabledChecks(runLevel int) []checks.Check {
+// EnabledChecks returns all the checks enabled by the profile, with its
+// overrides applied. It returns an error if the profile is unknown or one of
+// its overrides is invalid.
+//
+// When subdirectories have their own config file, each check is run on the
+// packages of each subtree with the subtree's configuration.
+func (c *Config) EnabledChecks(profile string) ([]checks.Check, error) {
+	p, c, err := c.useProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.subtrees) != 0 {
+		return c.partitionedChecks(p), nil
+	}
 	out := []checks.Check{}
 	for _, c := range c.AllChecks() {
-		if c.GetRunLevel() <= runLevel {
+		if p.enables(c.GetName(), c.GetRunLevel()) {
 			out = append(out, c)
 		}
 	}
-	return out
+	return out, nil
+}
+
+// AllMessageChecks returns all the commit message checks.
+func (c *Config) AllMessageChecks() []checks.MessageCheck {
+	return []checks.MessageCheck{
+		c.SubjectLength.Check(),
+		c.Trailer.Check(),
+		c.NoWIP.Check(),
+		c.SignOff.Check(),
+	}
+}
+
+// EnabledMessageChecks returns all the commit message checks enabled by the
+// profile, with its overrides applied. It returns an error like
+// EnabledChecks().
+func (c *Config) EnabledMessageChecks(profile string) ([]checks.MessageCheck, error) {
+	p, c, err := c.useProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+	out := []checks.MessageCheck{}
+	for _, c := range c.AllMessageChecks() {
+		if p.enables(c.GetName(), c.GetRunLevel()) {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// isEnabled returns true if a check with level checkLevel is to be run at
+// runLevel. A check with level 0 is never run.
+func isEnabled(checkLevel, runLevel int) bool {
+	return checkLevel != 0 && checkLevel <= runLevel
 }
 
 // Commands.
 
 func help(name, usage string) error {
+	config := getConfigOrDefaults(name)
 	s := &struct {
-		Usage        string
-		Max          int
-		NativeChecks []checks.Check
-		OtherChecks  []checks.Check
+		Usage         string
+		Max           int
+		NativeChecks  []checks.Check
+		OtherChecks   []checks.Check
+		MessageChecks []checks.MessageCheck
+		Profiles      []string
 	}{
 		usage,
 		0,
 		[]checks.Check{},
 		[]checks.Check{},
+		config.AllMessageChecks(),
+		config.profileNames(),
 	}
-	for _, c := range getConfig(name).AllChecks() {
+	for _, c := range s.MessageChecks {
+		if v := len(c.GetName()); v > s.Max {
+			s.Max = v
+		}
+	}
+	for _, c := range config.AllChecks() {
 		if v := len(c.GetName()); v > s.Max {
 			s.Max = v
 		}
@@ -225,11 +442,22 @@ func help(name, usage string) error {
 	return helpText.Execute(os.Stdout, s)
 }
 
-// installPrereq installs all the packages needed to run the enabled checks.
-func installPrereq(name string, runLevel int) error {
-	config := getConfig(name)
+// installPrereq installs all the packages needed to run the checks enabled by
+// the profiles.
+func installPrereq(name string, profiles []string) error {
+	config, err := getConfig(name)
+	if err != nil {
+		return err
+	}
 	var wg sync.WaitGroup
-	enabledChecks := config.EnabledChecks(runLevel)
+	enabledChecks := []checks.Check{}
+	for _, p := range profiles {
+		enabled, err := config.EnabledChecks(p)
+		if err != nil {
+			return err
+		}
+		enabledChecks = append(enabledChecks, enabled...)
+	}
 	c := make(chan string, len(enabledChecks))
 	for _, check := range enabledChecks {
 		for _, p := range check.GetPrerequisites() {
@@ -284,71 +512,376 @@ func installPrereq(name string, runLevel int) error {
 	return nil
 }
 
-// install first calls installPrereq() then install the .git/hooks/pre-commit hook.
-func install(name string, runLevel int) error {
-	if err := installPrereq(name, runLevel); err != nil {
+// install first calls installPrereq() then install the git hooks listed in
+// hookTypes, e.g. .git/hooks/pre-commit.
+func install(name, profile string, hookTypes []string) error {
+	config, err := getConfig(name)
+	if err != nil {
+		return err
+	}
+	// The prerequisites must cover the profile of every hook installed.
+	profiles := []string{profile}
+	for _, hookType := range hookTypes {
+		settings := config.hookSettings(hookType)
+		if settings == nil {
+			return fmt.Errorf("unsupported hook %q", hookType)
+		}
+		profiles = append(profiles, settings.profile())
+	}
+	if err := installPrereq(name, profiles); err != nil {
 		return err
 	}
 	gitDir, err := captureAbs("git", "rev-parse", "--git-dir")
 	if err != nil {
 		return fmt.Errorf("failed to find .git dir: %s", err)
 	}
-	// Always remove "pre-commit" first if it exists, in case it's a symlink.
-	p := filepath.Join(gitDir, "hooks", "pre-commit")
-	_ = os.Remove(p)
-	err = ioutil.WriteFile(p, preCommitHook, 0766)
+	hooksDir := filepath.Join(gitDir, "hooks")
+	if err := os.MkdirAll(hooksDir, 0777); err != nil {
+		return err
+	}
+	for _, hookType := range hookTypes {
+		if err := installHook(hooksDir, hookType); err != nil {
+			return err
+		}
+	}
 	log.Printf("installation done")
-	return err
+	return nil
 }
 
-// run runs all the enabled checks.
-func run(name string, runLevel int) error {
+// uninstall removes the git hooks installed by pre-commit-go and restores the
+// hooks they replaced.
+func uninstall() error {
+	gitDir, err := captureAbs("git", "rev-parse", "--git-dir")
+	if err != nil {
+		return fmt.Errorf("failed to find .git dir: %s", err)
+	}
+	for _, hookType := range hookTypes {
+		if err := uninstallHook(filepath.Join(gitDir, "hooks"), hookType); err != nil {
+			return err
+		}
+	}
+	log.Printf("uninstallation done")
+	return nil
+}
+
+// run runs all the enabled checks. If change is not nil, the checks only look
+// at the modified files.
+func run(ctx context.Context, name string, opts *options, change *checks.Change) error {
 	start := time.Now()
-	config := getConfig(name)
-	enabledChecks := config.EnabledChecks(runLevel)
+	config, err := getConfig(name)
+	if err != nil {
+		return err
+	}
+	if change != nil && opts.format == "text" {
+		printAffected(change)
+	}
+	result, err := runChecks(ctx, config, opts, change)
+	if err != nil {
+		return err
+	}
+	duration := time.Now().Sub(start)
+	if opts.baseline != nil && opts.shrinkBaseline && change == nil {
+		removed, err := opts.baseline.shrink()
+		if err != nil {
+			return fmt.Errorf("failed to update %s: %s", baselineFileName, err)
+		}
+		if removed != 0 && opts.format == "text" {
+			fmt.Printf("removed %d fixed findings from %s\n", removed, baselineFileName)
+		}
+	}
+	if opts.format == "json" {
+		if err := writeJSONReport(os.Stdout, opts, change, result, duration); err != nil {
+			return err
+		}
+	} else {
+		printResult(result)
+	}
+	if opts.junit != "" {
+		if err := writeJUnitReport(opts.junit, result); err != nil {
+			return fmt.Errorf("failed to write %s: %s", opts.junit, err)
+		}
+	}
+	if opts.sarif != "" {
+		if err := writeSARIFReport(opts.sarif, result); err != nil {
+			return fmt.Errorf("failed to write %s: %s", opts.sarif, err)
+		}
+	}
+	if len(result.failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("checks failed in %1.2fs", duration.Seconds())
+}
+
+// printResult prints the skipped and failed checks.
+func printResult(result *runResult) {
+	for _, name := range sortedResults(result.results) {
+		for _, t := range result.results[name].Tests {
+			if t.Flaky {
+				fmt.Printf("flaky test %s.%s: failed then passed when retried\n", t.Package, t.Name)
+			}
+			if t.Quarantined {
+				fmt.Printf("quarantined test %s.%s failed\n", t.Package, t.Name)
+			}
+		}
+	}
+	for _, name := range sortedSkipped(result.skipped) {
+		fmt.Printf("skipped %s: %s\n", name, result.skipped[name])
+	}
+	for _, name := range sortedNames(result.failed) {
+		fmt.Printf("%s\n", result.failed[name])
+	}
+	if len(result.cancelled) != 0 {
+		completed := []string{}
+		for _, c := range result.enabled {
+			if result.completed[c.GetName()] {
+				completed = append(completed, c.GetName())
+			}
+		}
+		fmt.Printf("cancelled after the first failure: %s\ncompleted: %s\n", strings.Join(result.cancelled, ", "), strings.Join(completed, ", "))
+	}
+}
+
+// runResult is the outcome of runChecks.
+type runResult struct {
+	// enabled is the checks enabled by the profile, in the configuration
+	// order.
+	enabled []checks.Check
+	// results is the result of each enabled check, keyed by the check name.
+	results map[string]*checks.Result
+	// failed is the error of each check that failed, keyed by the check name.
+	failed map[string]error
+	// cancelled lists the checks killed in fail fast mode, sorted.
+	cancelled []string
+	// skipped is the reason each check was not run, keyed by the check name.
+	skipped map[string]string
+	// completed is the checks that ran to the end, passed or failed.
+	completed map[string]bool
+}
+
+// runChecks runs the enabled checks concurrently.
+//
+// A check starts once all the enabled checks listed in its DependsOn
+// succeeded; it is skipped if one of them failed or was skipped. Dependencies
+// that are not enabled by the profile are ignored.
+//
+// Each check is killed when it exceeds its maximum duration or when ctx is
+// done. In fail fast mode, the checks still running or waiting when one fails
+// are killed and returned as cancelled instead of failed.
+//
+// It returns an error if the profile can't be used.
+func runChecks(ctx context.Context, config *Config, opts *options, change *checks.Change) (*runResult, error) {
+	failFast := opts.failFast || config.FailFast
+	ctx, cancelAll := context.WithCancel(ctx)
+	defer cancelAll()
+	type node struct {
+		done   chan struct{}
+		passed bool
+	}
+	all, err := config.EnabledChecks(opts.profile)
+	if err != nil {
+		return nil, err
+	}
+	enabled := all
+	if opts.affectedOnly {
+		enabled = []checks.Check{}
+		for _, c := range all {
+			if c = checks.ForChange(c, change); c != nil {
+				enabled = append(enabled, c)
+			}
+		}
+	}
+	nodes := map[string]*node{}
+	for _, c := range enabled {
+		nodes[c.GetName()] = &node{done: make(chan struct{})}
+	}
+	var cache *checks.Cache
+	if opts.cacheDir != "" {
+		cache = checks.NewCache(opts.cacheDir)
+	}
+	if opts.baseline != nil {
+		opts.baseline.reset()
+	}
+	var lock sync.Mutex
+	// cancelledByFailFast is set when the checks are killed because one
+	// failed in fail fast mode, as opposed to ctx being done. It is protected
+	// by lock.
+	cancelledByFailFast := false
+	result := &runResult{
+		enabled:   all,
+		results:   map[string]*checks.Result{},
+		failed:    map[string]error{},
+		cancelled: []string{},
+		skipped:   map[string]string{},
+		completed: map[string]bool{},
+	}
 	var wg sync.WaitGroup
-	errs := make(chan error, len(enabledChecks))
-	for _, c := range enabledChecks {
+	for _, c := range enabled {
 		wg.Add(1)
 		go func(check checks.Check) {
 			defer wg.Done()
-			log.Printf("%s...", check.GetName())
-			start := time.Now()
-			err := check.Run()
-			duration := time.Now().Sub(start)
-			log.Printf("... %s in %1.2fs", check.GetName(), duration.Seconds())
-			if err != nil {
-				errs <- err
+			self := nodes[check.GetName()]
+			// Closed last so that dependents see self.passed.
+			defer close(self.done)
+			for _, dep := range check.GetDependsOn() {
+				n := nodes[dep]
+				if n == nil {
+					continue
+				}
+				select {
+				case <-n.done:
+				case <-ctx.Done():
+				}
+				lock.Lock()
+				result.results[check.GetName()] = &checks.Result{Name: check.GetName(), Status: checks.Skipped}
+				if ctx.Err() != nil {
+					if cancelledByFailFast {
+						result.cancelled = append(result.cancelled, check.GetName())
+					} else {
+						result.skipped[check.GetName()] = "interrupted while waiting for " + dep
+					}
+					lock.Unlock()
+					return
+				}
+				if !n.passed {
+					state := "failed"
+					if _, ok := result.skipped[dep]; ok {
+						state = "was skipped"
+					}
+					result.skipped[check.GetName()] = fmt.Sprintf("%s %s", dep, state)
+					lock.Unlock()
+					return
+				}
+				lock.Unlock()
 			}
-			// A check that took too long is a check that failed.
+			// A check that takes too long is a check that failed.
 			max := check.GetMaxDuration()
 			if max == 0 {
 				max = config.MaxDuration
 			}
-			if duration > time.Duration(max)*time.Second {
-				errs <- fmt.Errorf("check %s took %1.2fs", check.GetName(), duration.Seconds())
+			var r *checks.Result
+			if cache != nil {
+				r = cache.Get(ctx, check, change)
+			}
+			if r != nil {
+				log.Printf("%s passed before on the same sources", check.GetName())
+			} else {
+				checkCtx, cancel := context.WithTimeout(ctx, time.Duration(max)*time.Second)
+				log.Printf("%s...", check.GetName())
+				r = check.Run(checkCtx, change)
+				cancel()
+				log.Printf("... %s in %1.2fs", check.GetName(), r.Duration.Seconds())
+				if cache != nil {
+					if err := cache.Put(ctx, check, change, r); err != nil {
+						log.Printf("failed to cache %s: %s", check.GetName(), err)
+					}
+				}
+			}
+			if opts.baseline != nil {
+				opts.baseline.filter(r)
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			result.results[check.GetName()] = r
+			if r.Status == checks.Passed {
+				result.completed[check.GetName()] = true
+				self.passed = true
+				return
+			}
+			err := r.Err
+			if r.Status == checks.TimedOut {
+				err = fmt.Errorf("check %s timed out after %1.2fs:\n%s", check.GetName(), r.Duration.Seconds(), err)
+			} else if ctx.Err() != nil {
+				if cancelledByFailFast {
+					r.Status = checks.Skipped
+					result.cancelled = append(result.cancelled, check.GetName())
+					return
+				}
+				err = fmt.Errorf("check %s was interrupted:\n%s", check.GetName(), err)
+			} else {
+				result.completed[check.GetName()] = true
+			}
+			result.failed[check.GetName()] = err
+			if failFast {
+				// Only if the checks were not already interrupted.
+				if ctx.Err() == nil {
+					cancelledByFailFast = true
+				}
+				cancelAll()
 			}
 		}(c)
 	}
 	wg.Wait()
+	sort.Strings(result.cancelled)
+	if opts.timings != "" {
+		if err := recordTimings(opts.timings, opts.profile, result); err != nil {
+			log.Printf("failed to record the durations: %s", err)
+		}
+	}
+	return result, nil
+}
 
-	var err error
-	for {
-		select {
-		case err = <-errs:
-			fmt.Printf("%s\n", err)
-		default:
-			if err != nil {
-				duration := time.Now().Sub(start)
-				return fmt.Errorf("checks failed in %1.2fs", duration.Seconds())
-			}
-			return err
+// output returns the human readable output of the check name if it did not
+// pass, or why it was not run.
+func (r *runResult) output(name string) string {
+	if err := r.failed[name]; err != nil {
+		return err.Error()
+	}
+	if reason, ok := r.skipped[name]; ok {
+		return reason
+	}
+	for _, c := range r.cancelled {
+		if c == name {
+			return "cancelled after the first failure"
 		}
 	}
+	return ""
+}
+
+// sortedNames returns the check names of failed, sorted.
+func sortedNames(failed map[string]error) []string {
+	names := make([]string, 0, len(failed))
+	for name := range failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedResults returns the check names of results, sorted.
+func sortedResults(results map[string]*checks.Result) []string {
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedSkipped returns the check names of skipped, sorted.
+func sortedSkipped(skipped map[string]string) []string {
+	names := make([]string, 0, len(skipped))
+	for name := range skipped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// printAffected prints the packages whose tests are run and why.
+func printAffected(change *checks.Change) {
+	affected := change.AffectedPackages()
+	pkgs := make([]string, 0, len(affected))
+	for pkg := range affected {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	for _, pkg := range pkgs {
+		fmt.Printf("%s: %s\n", pkg, affected[pkg])
+	}
 }
 
 func writeConfig(name string) error {
-	config := getConfig(name)
+	config := getConfigOrDefaults(name)
 	content, err := yaml.Marshal(config)
 	if err != nil {
 		return fmt.Errorf("internal error when marshaling config: %s", err)
@@ -370,7 +903,20 @@ func mainImpl() error {
 	}
 	verbose := flag.Bool("verbose", false, "enables verbose logging output")
 	configPath := flag.String("config", "pre-commit-go.yml", "file name of the config to load")
-	runLevel := flag.Int("level", 1, "runlevel, between 0 and 3; the higher, the more tests are run")
+	jobs := flag.Int("j", 0, "maximum number of processes run concurrently by all the checks; defaults to the number of CPUs")
+	failFast := flag.Bool("failfast", false, "cancels the remaining checks as soon as one fails; implied by 'failfast: true' in the config")
+	profile := flag.String("profile", "1", "checks to run: a profile of the config or a run level between 0 and 3, the higher the more tests are run; hook defaults to the hook's profile in the config")
+	runLevel := flag.Int("level", 1, "runlevel, between 0 and 3; same as -profile")
+	hooks := flag.String("hooks", "pre-commit", "install: comma separated git hooks to install, any of: "+strings.Join(hookTypes, ", "))
+	diffRev := flag.String("diff", "", "hook and run: only checks the files modified since this revision; hook defaults to the staged changes")
+	revRangeFlag := flag.String("range", "", "run: runs the checks on each commit of a revision range like origin/master..HEAD")
+	tipOnly := flag.Bool("tiponly", false, "run: with -range, only checks the tip of the range")
+	isolated := flag.Bool("isolated", false, "hook and run: runs the checks on the index in a temporary checkout; implied by 'isolated: true' in the config")
+	recoverFlag := flag.Bool("recover", false, "hook only: restores the working tree after an interrupted run")
+	format := flag.String("format", "text", "run: output format, text or json")
+	junit := flag.String("junit", "", "run: writes a JUnit XML report to this file")
+	sarif := flag.String("sarif", "", "run: writes a SARIF report of the problems found to this file")
+	noCache := flag.Bool("nocache", false, "hook and run: runs all the checks, even those that passed before on the same sources")
 	flag.Parse()
 
 	log.SetFlags(log.Lmicroseconds)
@@ -378,9 +924,45 @@ func mainImpl() error {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	if *runLevel < 0 || *runLevel > 3 {
-		return fmt.Errorf("-level %d is invalid, must be between 0 and 3", *runLevel)
+	profileSet := false
+	levelSet := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "profile":
+			profileSet = true
+		case "level":
+			levelSet = true
+		}
+	})
+	if levelSet {
+		if profileSet {
+			return errors.New("-level and -profile cannot be used together")
+		}
+		if *runLevel < 0 || *runLevel > 3 {
+			return fmt.Errorf("-level %d is invalid, must be between 0 and 3", *runLevel)
+		}
+		*profile = strconv.Itoa(*runLevel)
+		profileSet = true
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("-format %s is invalid, must be text or json", *format)
 	}
+	// The reports are relative to the current directory, not to the checkout
+	// root.
+	for _, p := range []*string{junit, sarif} {
+		if *p != "" {
+			var err error
+			if *p, err = filepath.Abs(*p); err != nil {
+				return err
+			}
+		}
+	}
+	checks.SetJobs(*jobs)
+	opts := &options{profile: *profile, failFast: *failFast, format: *format, junit: *junit, sarif: *sarif}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelOnSignal(cancel)
 
 	gitRoot, err := captureAbs("git", "rev-parse", "--show-cdup")
 	if err != nil {
@@ -390,26 +972,144 @@ func mainImpl() error {
 		return fmt.Errorf("failed to chdir to git checkout root: %s", err)
 	}
 
+	if !*noCache {
+		if opts.cacheDir, err = gitPath(cacheDirName); err != nil {
+			return err
+		}
+	}
+	if opts.timings, err = gitPath(timingsFileName); err != nil {
+		return err
+	}
+	// The config, the profile and the baseline are only loaded by the commands
+	// using them, so that the others still work when a file is broken.
+	useProfile := func() error {
+		if !profileSet {
+			return nil
+		}
+		return checkProfile(*configPath, opts.profile)
+	}
+	useBaseline := func() error {
+		if err := useProfile(); err != nil {
+			return err
+		}
+		var err error
+		opts.baseline, err = loadBaseline(baselineFileName)
+		return err
+	}
+
 	if cmd == "help" || cmd == "-help" || cmd == "-h" {
 		b := &bytes.Buffer{}
 		flag.CommandLine.SetOutput(b)
 		flag.CommandLine.PrintDefaults()
 		return help(*configPath, b.String())
 	}
+	if cmd == "hook" {
+		if *recoverFlag {
+			return recoverHook()
+		}
+		if err := useBaseline(); err != nil {
+			return err
+		}
+		hookType := "pre-commit"
+		args := flag.Args()
+		if len(args) != 0 {
+			hookType = args[0]
+			args = args[1:]
+		}
+		if !profileSet {
+			opts.profile = ""
+		}
+		// The hooks' output is read by humans.
+		opts.format = "text"
+		opts.junit = ""
+		opts.sarif = ""
+		return hook(ctx, *configPath, hookType, args, opts, *isolated, *diffRev)
+	}
+	if cmd == "baseline" {
+		if err := useProfile(); err != nil {
+			return err
+		}
+		return writeBaseline(ctx, *configPath, opts)
+	}
+	if cmd == "config" {
+		args := flag.Args()
+		if len(args) == 0 || args[0] != "show" || len(args) > 2 || (len(args) == 2 && args[1] != "-resolved") {
+			return errors.New("unknown config command, only 'config show [-resolved]' is supported")
+		}
+		return showConfig(os.Stdout, *configPath, len(args) == 2)
+	}
+	if cmd == "cache" {
+		if args := flag.Args(); len(args) != 1 || args[0] != "clean" {
+			return errors.New("unknown cache command, only 'cache clean' is supported")
+		}
+		return cleanCache()
+	}
 	if cmd == "install" || cmd == "i" {
-		return install(*configPath, *runLevel)
+		if err := useProfile(); err != nil {
+			return err
+		}
+		return install(*configPath, opts.profile, strings.Split(*hooks, ","))
 	}
 	if cmd == "installrun" {
-		if err := install(*configPath, *runLevel); err != nil {
+		if err := useBaseline(); err != nil {
 			return err
 		}
-		return run(*configPath, *runLevel)
+		if err := install(*configPath, opts.profile, strings.Split(*hooks, ",")); err != nil {
+			return err
+		}
+		opts.shrinkBaseline = true
+		return run(ctx, *configPath, opts, nil)
 	}
 	if cmd == "prereq" || cmd == "p" {
-		return installPrereq(*configPath, *runLevel)
+		if err := useProfile(); err != nil {
+			return err
+		}
+		return installPrereq(*configPath, []string{opts.profile})
 	}
 	if cmd == "run" || cmd == "r" {
-		return run(*configPath, *runLevel)
+		if err := useBaseline(); err != nil {
+			return err
+		}
+		if *revRangeFlag != "" {
+			if *diffRev != "" || *isolated {
+				return errors.New("-range cannot be used with -diff or -isolated")
+			}
+			if *format != "text" || *junit != "" || *sarif != "" {
+				return errors.New("-range only supports the text output, without -format, -junit or -sarif")
+			}
+			return runRange(ctx, *configPath, opts, *revRangeFlag, *tipOnly)
+		}
+		config, err := getConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		isolated := *isolated || config.Isolated
+		var change *checks.Change
+		if *diffRev != "" {
+			if change, err = getChange(*diffRev, isolated); err != nil {
+				return err
+			}
+		}
+		if isolated {
+			return runIsolated(ctx, *configPath, opts, change)
+		}
+		opts.shrinkBaseline = true
+		return run(ctx, *configPath, opts, change)
+	}
+	if cmd == "stats" {
+		return stats(*configPath, opts.timings)
+	}
+	if cmd == "uninstall" {
+		return uninstall()
+	}
+	if cmd == "validate" {
+		return validateConfig(*configPath)
+	}
+	if cmd == "watch" {
+		if err := useBaseline(); err != nil {
+			return err
+		}
+		return watch(ctx, *configPath, opts)
 	}
 	if cmd == "writeconfig" || cmd == "w" {
 		return writeConfig(*configPath)
@@ -0,0 +1,221 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/maruel/pre-commit-go/checks"
+	"gopkg.in/yaml.v2"
+)
+
+// builtinProfile returns the built-in profile name, which enables the checks
+// up to a run level between "0" and "3".
+func builtinProfile(name string) (*Profile, bool) {
+	l, err := strconv.Atoi(name)
+	if err != nil || l < 0 || l > 3 || strconv.Itoa(l) != name {
+		return nil, false
+	}
+	return &Profile{RunLevel: l}, true
+}
+
+// getProfile returns the profile name, either a built-in one or one of the
+// config.
+func (c *Config) getProfile(name string) (*Profile, error) {
+	if p, ok := builtinProfile(name); ok {
+		return p, nil
+	}
+	if p, ok := c.Profiles[name]; ok {
+		if p == nil {
+			// An empty profile in the config file.
+			p = &Profile{}
+		}
+		return p, nil
+	}
+	msg := fmt.Sprintf("unknown profile %q, must be a run level between 0 and 3", name)
+	if names := c.profileNames(); len(names) != 0 {
+		msg += " or one of " + strings.Join(names, ", ")
+	}
+	return nil, errors.New(msg)
+}
+
+// profileNames returns the names of the profiles of the config, sorted.
+func (c *Config) profileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkProfile returns an error if the profile is not defined by the config
+// file name.
+func checkProfile(name, profile string) error {
+	config, err := getConfig(name)
+	if err != nil {
+		return err
+	}
+	_, err = config.getProfile(profile)
+	return err
+}
+
+// enables returns true if the check name, whose run level is runLevel, is run
+// with this profile.
+func (p *Profile) enables(name string, runLevel int) bool {
+	if isEnabled(runLevel, p.RunLevel) {
+		return true
+	}
+	for _, n := range p.Checks {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// useProfile returns the profile name along with the configuration with its
+// overrides applied. The configuration is c itself when the profile has no
+// override.
+func (c *Config) useProfile(name string) (*Profile, *Config, error) {
+	p, err := c.getProfile(name)
+	if err != nil || len(p.Overrides) == 0 {
+		return p, c, err
+	}
+	out, err := c.clone()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := out.override(p.Overrides); err != nil {
+		return nil, nil, err
+	}
+	return p, out, nil
+}
+
+// clone returns a copy of the configuration, including the one of its
+// subtrees.
+func (c *Config) clone() (*Config, error) {
+	content, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	out := &Config{}
+	if err := yaml.Unmarshal(content, out); err != nil {
+		return nil, err
+	}
+	for _, s := range c.subtrees {
+		config, err := s.config.clone()
+		if err != nil {
+			return nil, err
+		}
+		out.subtrees = append(out.subtrees, &subtree{s.dir, config})
+	}
+	return out, nil
+}
+
+// override applies the settings in overrides, keyed by check name, to the
+// checks of the configuration and of its subtrees.
+func (c *Config) override(overrides map[string]yaml.MapSlice) error {
+	for _, k := range c.keys() {
+		if o, ok := overrides[k.v.GetName()]; ok {
+			if err := applyOverride(k.settings, o); err != nil {
+				return fmt.Errorf("%s: %s", k.v.GetName(), err)
+			}
+		}
+	}
+	for _, s := range c.subtrees {
+		if err := s.config.override(overrides); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyOverride sets the values of o in the configuration of a check.
+func applyOverride(settings interface{}, o yaml.MapSlice) error {
+	content, err := yaml.Marshal(o)
+	if err != nil {
+		return err
+	}
+	err = yaml.UnmarshalStrict(content, settings)
+	if err == nil {
+		return nil
+	}
+	msgs := []string{err.Error()}
+	if t, ok := err.(*yaml.TypeError); ok {
+		msgs = t.Errors
+	}
+	for i, msg := range msgs {
+		msg = yamlUnknownRe.ReplaceAllString(msg, "unknown key $1")
+		// The line is the one in o, not in the file.
+		if m := yamlLineRe.FindStringSubmatch(msg); m != nil {
+			msg = m[2]
+		}
+		msgs[i] = msg
+	}
+	return errors.New(strings.Join(msgs, ", "))
+}
+
+// validateProfiles reports the invalid values of the profiles with add.
+func (c *Config) validateProfiles(add func(path []string, msg string)) {
+	known := map[string]bool{}
+	for _, k := range c.keys() {
+		known[k.v.GetName()] = true
+	}
+	for _, name := range c.profileNames() {
+		p := c.Profiles[name]
+		if _, ok := builtinProfile(name); ok {
+			add([]string{"profiles", name}, "is a built-in profile, use another name")
+			continue
+		}
+		if p == nil {
+			continue
+		}
+		if p.RunLevel < 0 || p.RunLevel > 3 {
+			add([]string{"profiles", name, "runlevel"}, fmt.Sprintf("must be between 0 and 3, got %d", p.RunLevel))
+		}
+		for i, check := range p.Checks {
+			if !known[check] {
+				add([]string{"profiles", name, "checks", strconv.Itoa(i)}, fmt.Sprintf("unknown check %q", check))
+			}
+		}
+		overridden := make([]string, 0, len(p.Overrides))
+		for check := range p.Overrides {
+			overridden = append(overridden, check)
+		}
+		sort.Strings(overridden)
+		for _, check := range overridden {
+			path := []string{"profiles", name, "overrides", check}
+			if !known[check] {
+				add(path, "is an unknown check")
+				continue
+			}
+			// Validate the check as configured by this profile.
+			config, err := c.clone()
+			if err != nil {
+				add(path, err.Error())
+				continue
+			}
+			for _, k := range config.keys() {
+				if k.v.GetName() != check {
+					continue
+				}
+				if err := applyOverride(k.settings, p.Overrides[check]); err != nil {
+					add(path, err.Error())
+				} else if err := k.v.Validate(); err != nil {
+					if e, ok := err.(*checks.ConfigError); ok {
+						add(append(path, e.Field), e.Message)
+					} else {
+						add(path, err.Error())
+					}
+				}
+			}
+		}
+	}
+}
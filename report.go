@@ -0,0 +1,322 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/maruel/pre-commit-go/checks"
+)
+
+// jsonReport is the document written by 'run -format json'.
+type jsonReport struct {
+	// RunLevel is the run level the checks were selected with, only when the
+	// profile is a run level.
+	RunLevel *int `json:"runlevel,omitempty"`
+	// Profile is the profile the checks were selected with, e.g. "2".
+	Profile string `json:"profile"`
+	// Status is "pass" if all the checks passed, "fail" otherwise.
+	Status checks.Status `json:"status"`
+	// Duration is the total run time, in seconds.
+	Duration float64 `json:"duration"`
+	// Affected is the packages tested and why, only when a subset of the tree
+	// was checked.
+	Affected map[string]string `json:"affected,omitempty"`
+	// Checks lists every enabled check, in the configuration order.
+	Checks []jsonCheck `json:"checks"`
+}
+
+// jsonCheck is the result of one check in a jsonReport.
+type jsonCheck struct {
+	Name     string        `json:"name"`
+	RunLevel int           `json:"runlevel"`
+	Status   checks.Status `json:"status"`
+	// Duration is in seconds. For a cached check, it is the duration of the
+	// run that was cached.
+	Duration float64 `json:"duration"`
+	// Cached is true if the check passed before on the same sources and was
+	// not run again.
+	Cached bool `json:"cached"`
+	// Output is the human readable output of a check that did not pass, or
+	// why it was skipped.
+	Output   string           `json:"output"`
+	Findings []checks.Finding `json:"findings"`
+	// Flaky lists the tests that failed then passed when retried, like
+	// "github.com/foo/bar.TestFoo".
+	Flaky []string `json:"flaky,omitempty"`
+	// Quarantined lists the tests that failed but are in quarantine.
+	Quarantined []string `json:"quarantined,omitempty"`
+}
+
+// writeJSONReport writes the result of every enabled check as a JSON
+// document.
+func writeJSONReport(w io.Writer, opts *options, change *checks.Change, result *runResult, duration time.Duration) error {
+	report := &jsonReport{
+		Profile:  opts.profile,
+		Status:   checks.Passed,
+		Duration: duration.Seconds(),
+		Checks:   []jsonCheck{},
+	}
+	if p, ok := builtinProfile(opts.profile); ok {
+		report.RunLevel = &p.RunLevel
+	}
+	if len(result.failed) != 0 {
+		report.Status = checks.Failed
+	}
+	if change != nil {
+		report.Affected = change.AffectedPackages()
+	}
+	for _, c := range result.enabled {
+		name := c.GetName()
+		j := jsonCheck{Name: name, RunLevel: c.GetRunLevel(), Status: checks.Skipped, Findings: []checks.Finding{}}
+		if r := result.results[name]; r != nil {
+			j.Status = r.Status
+			j.Duration = r.Duration.Seconds()
+			j.Cached = r.Cached
+			if r.Findings != nil {
+				j.Findings = r.Findings
+			}
+			for _, t := range r.Tests {
+				if t.Flaky {
+					j.Flaky = append(j.Flaky, t.Package+"."+t.Name)
+				}
+				if t.Quarantined {
+					j.Quarantined = append(j.Quarantined, t.Package+"."+t.Name)
+				}
+			}
+		}
+		j.Output = result.output(name)
+		report.Checks = append(report.Checks, j)
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(report)
+}
+
+// junitTestSuites is the document written by 'run -junit'. Each check is a
+// test suite.
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	// FlakyFailure is the failure of a test that passed when retried, like
+	// the Maven Surefire plugin reports it.
+	FlakyFailure *junitMessage `xml:"flakyFailure,omitempty"`
+	SystemOut    string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitTime formats a duration in seconds like JUnit does.
+func junitTime(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// writeJUnitReport writes the result of every enabled check as a JUnit XML
+// file.
+//
+// Each check is a test suite. The checks running Go tests with -v have a test
+// case per test; the other checks have a single test case named after the
+// check. The failed tests in quarantine are reported as skipped.
+func writeJUnitReport(path string, result *runResult) error {
+	doc := &junitTestSuites{Suites: []junitTestSuite{}}
+	for _, c := range result.enabled {
+		name := c.GetName()
+		suite := junitTestSuite{Name: name, Cases: []junitTestCase{}}
+		r := result.results[name]
+		if r == nil {
+			r = &checks.Result{Name: name, Status: checks.Skipped}
+		}
+		suite.Time = junitTime(r.Duration)
+		testFailed := false
+		for _, t := range r.Tests {
+			tc := junitTestCase{ClassName: t.Package, Name: t.Name, Time: junitTime(t.Duration)}
+			switch {
+			case t.Quarantined:
+				tc.Skipped = &junitMessage{Message: t.Name + " failed but is quarantined", Text: t.Output}
+			case t.Flaky:
+				tc.FlakyFailure = &junitMessage{Message: t.Name + " failed then passed when retried", Text: t.Output}
+			case t.Status == checks.Failed:
+				tc.Failure = &junitMessage{Message: t.Name + " failed", Text: t.Output}
+				testFailed = true
+			case t.Status == checks.Skipped:
+				tc.Skipped = &junitMessage{Message: t.Name + " skipped", Text: t.Output}
+			default:
+				tc.SystemOut = t.Output
+			}
+			suite.Cases = append(suite.Cases, tc)
+		}
+		// The failures not caused by a test, e.g. a build error or a timeout,
+		// are reported as a test case named after the check.
+		if len(r.Tests) == 0 || (r.Status != checks.Passed && !testFailed) {
+			tc := junitTestCase{ClassName: name, Name: name, Time: junitTime(r.Duration)}
+			switch r.Status {
+			case checks.Failed, checks.TimedOut:
+				tc.Failure = &junitMessage{Message: fmt.Sprintf("check %s: %s", name, r.Status), Text: result.output(name)}
+			case checks.Skipped:
+				tc.Skipped = &junitMessage{Message: result.output(name)}
+			}
+			suite.Cases = append(suite.Cases, tc)
+		}
+		for _, tc := range suite.Cases {
+			suite.Tests++
+			if tc.Failure != nil {
+				suite.Failures++
+			} else if tc.Skipped != nil {
+				suite.Skipped++
+			}
+		}
+		doc.Suites = append(doc.Suites, suite)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, xml.Header)
+	if err == nil {
+		e := xml.NewEncoder(f)
+		e.Indent("", "  ")
+		err = e.Encode(doc)
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// sarifLog is the document written by 'run -sarif', following the SARIF 2.1.0
+// format. Each check is a run.
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID string `json:"id"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	RuleIndex int             `json:"ruleIndex"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI       string `json:"uri"`
+	URIBaseID string `json:"uriBaseId"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+// writeSARIFReport writes the findings of every enabled check as a SARIF
+// file. The file paths are relative to the root of the checkout, which is
+// %SRCROOT%.
+func writeSARIFReport(path string, result *runResult) error {
+	doc := &sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{},
+	}
+	for _, c := range result.enabled {
+		run := sarifRun{
+			Tool: sarifTool{Driver: sarifDriver{
+				Name:           c.GetName(),
+				InformationURI: "https://github.com/maruel/pre-commit-go",
+				Rules:          []sarifRule{},
+			}},
+			Results: []sarifResult{},
+		}
+		ruleIndex := map[string]int{}
+		if r := result.results[c.GetName()]; r != nil {
+			for _, f := range r.Findings {
+				i, ok := ruleIndex[f.Rule]
+				if !ok {
+					i = len(run.Tool.Driver.Rules)
+					ruleIndex[f.Rule] = i
+					run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{ID: f.Rule})
+				}
+				res := sarifResult{RuleID: f.Rule, RuleIndex: i, Level: string(f.Severity), Message: sarifMessage{f.Message}}
+				if f.File != "" {
+					loc := sarifLocation{sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{f.File, "%SRCROOT%"}}}
+					if f.Line != 0 {
+						loc.PhysicalLocation.Region = &sarifRegion{f.Line, f.Column}
+					}
+					res.Locations = []sarifLocation{loc}
+				}
+				run.Results = append(run.Results, res)
+			}
+		}
+		doc.Runs = append(doc.Runs, run)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(f)
+	e.SetIndent("", "  ")
+	err = e.Encode(doc)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
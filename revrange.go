@@ -0,0 +1,172 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/maruel/pre-commit-go/checks"
+)
+
+// commit is a commit of a revision range.
+type commit struct {
+	hash    string
+	subject string
+}
+
+func (c *commit) String() string {
+	return c.hash[:12] + " " + c.subject
+}
+
+// revRange returns the commits of the revision range r, oldest first.
+func revRange(r string) ([]commit, error) {
+	if !strings.Contains(r, "..") {
+		return nil, fmt.Errorf("%q is not a revision range like origin/master..HEAD", r)
+	}
+	out, err := runGit("log", "--reverse", "--topo-order", "--format=%H %s", r, "--")
+	if err != nil {
+		return nil, err
+	}
+	if out == "" {
+		return nil, nil
+	}
+	commits := []commit{}
+	for _, line := range strings.Split(out, "\n") {
+		items := strings.SplitN(line, " ", 2)
+		if len(items) == 1 {
+			items = append(items, "")
+		}
+		commits = append(commits, commit{items[0], items[1]})
+	}
+	return commits, nil
+}
+
+// revFailure is a check that failed on a commit.
+type revFailure struct {
+	err error
+	// findings are the findings of the check, keyed like in the baseline so
+	// that they can be compared across commits.
+	findings []checks.Finding
+	keys     []baselineKey
+}
+
+// checkRev runs the enabled checks on the whole tree of revision rev in a
+// temporary checkout. It returns each check that failed, keyed by the check
+// name.
+func checkRev(ctx context.Context, name string, opts *options, rev string) (map[string]*revFailure, error) {
+	out := map[string]*revFailure{}
+	err := inRev(rev, func() error {
+		config, err := getConfig(name)
+		if err != nil {
+			return err
+		}
+		result, err := runChecks(ctx, config, opts, nil)
+		if err != nil {
+			return err
+		}
+		// The keys are computed in the checkout, as they include the content
+		// of the lines.
+		b := newBaseline("")
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		for check, err := range result.failed {
+			f := &revFailure{err: err}
+			if r := result.results[check]; r != nil {
+				f.findings = r.Findings
+				for i := range r.Findings {
+					f.keys = append(f.keys, b.key(check, &r.Findings[i]))
+				}
+			}
+			out[check] = f
+		}
+		return nil
+	})
+	return out, err
+}
+
+// newFindings returns the findings of f that were not found by the same check
+// on the previous commit.
+func (f *revFailure) newFindings(previous *revFailure) []checks.Finding {
+	known := map[baselineKey]int{}
+	for _, k := range previous.keys {
+		known[k]++
+	}
+	out := []checks.Finding{}
+	for i, k := range f.keys {
+		if known[k] > 0 {
+			known[k]--
+		} else {
+			out = append(out, f.findings[i])
+		}
+	}
+	return out
+}
+
+// runRange runs the enabled checks on each commit of the revision range r, or
+// only on its tip if tipOnly is set, and reports the commit that introduced
+// each failure.
+//
+// Each commit is checked on the whole tree in a temporary checkout. A failure
+// is introduced by a commit when the check didn't fail on the previous commit
+// or when it found new problems.
+func runRange(ctx context.Context, name string, opts *options, r string, tipOnly bool) error {
+	commits, err := revRange(r)
+	if err != nil {
+		return err
+	}
+	if len(commits) == 0 {
+		fmt.Printf("no commit in %s\n", r)
+		return nil
+	}
+	if tipOnly {
+		commits = commits[len(commits)-1:]
+	}
+	previous := map[string]*revFailure{}
+	introduced := []string{}
+	failedCommits := 0
+	for i := range commits {
+		c := &commits[i]
+		failed, err := checkRev(ctx, name, opts, c.hash)
+		if err != nil {
+			return err
+		}
+		if len(failed) == 0 {
+			fmt.Printf("%s: ok\n", c)
+		} else {
+			failedCommits++
+			fmt.Printf("%s: %d checks failed\n", c, len(failed))
+			names := make([]string, 0, len(failed))
+			for check := range failed {
+				names = append(names, check)
+			}
+			sort.Strings(names)
+			for _, check := range names {
+				f := failed[check]
+				state := "still failing"
+				if p := previous[check]; p == nil {
+					state = "introduced"
+					introduced = append(introduced, fmt.Sprintf("%s by %s", check, c.hash[:12]))
+				} else if fresh := f.newFindings(p); len(fresh) != 0 {
+					state = fmt.Sprintf("%d new problems", len(fresh))
+					introduced = append(introduced, fmt.Sprintf("%s by %s", check, c.hash[:12]))
+				}
+				fmt.Printf("  %s (%s):\n%s\n", check, state, indent(f.err.Error(), "    "))
+			}
+		}
+		previous = failed
+	}
+	if failedCommits == 0 {
+		return nil
+	}
+	return fmt.Errorf("checks failed on %d of %d commits; failures introduced: %s", failedCommits, len(commits), strings.Join(introduced, ", "))
+}
+
+// indent prefixes each line of s.
+func indent(s, prefix string) string {
+	return prefix + strings.Replace(strings.TrimRight(s, "\n"), "\n", "\n"+prefix, -1)
+}
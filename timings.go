@@ -0,0 +1,243 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/maruel/pre-commit-go/checks"
+)
+
+// timingsFileName is the file, relative to the .git directory, where the
+// durations of the checks are appended after each run, one JSON document per
+// line.
+const timingsFileName = "pre-commit-go.timings"
+
+// maxTimingsSize is the size of the timings file above which the oldest half
+// of the runs is dropped.
+const maxTimingsSize = 4 << 20
+
+// trendRuns is the number of runs compared to the same number of runs before
+// them to compute a trend.
+const trendRuns = 10
+
+// timingRecord is the durations of the checks of one run.
+type timingRecord struct {
+	Time    time.Time     `json:"time"`
+	Profile string        `json:"profile"`
+	Checks  []checkTiming `json:"checks"`
+}
+
+// checkTiming is the duration of a check. The durations are in seconds.
+type checkTiming struct {
+	Name     string          `json:"name"`
+	Status   checks.Status   `json:"status"`
+	Duration float64         `json:"duration"`
+	Packages []packageTiming `json:"packages,omitempty"`
+}
+
+type packageTiming struct {
+	Package  string  `json:"package"`
+	Duration float64 `json:"duration"`
+}
+
+// recordTimings appends the durations of the checks that ran to the file
+// path. The checks that were skipped or cached are not recorded.
+func recordTimings(path, profile string, result *runResult) error {
+	record := &timingRecord{Time: time.Now().UTC(), Profile: profile, Checks: []checkTiming{}}
+	for _, name := range sortedResults(result.results) {
+		r := result.results[name]
+		if r.Status == checks.Skipped || r.Cached {
+			continue
+		}
+		c := checkTiming{Name: name, Status: r.Status, Duration: r.Duration.Seconds()}
+		for _, p := range r.Packages {
+			c.Packages = append(c.Packages, packageTiming{p.Package, p.Duration.Seconds()})
+		}
+		record.Checks = append(record.Checks, c)
+	}
+	if len(record.Checks) == 0 {
+		return nil
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if stat, err := os.Stat(path); err == nil && stat.Size() > maxTimingsSize {
+		if err := trimTimings(path); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// trimTimings drops the oldest half of the runs recorded in the file path.
+func trimTimings(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	return ioutil.WriteFile(path, []byte(strings.Join(lines[len(lines)/2:], "")), 0600)
+}
+
+// readTimings returns the runs recorded in the file path, oldest first.
+func readTimings(path string) ([]timingRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records := []timingRecord{}
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, maxTimingsSize)
+	for s.Scan() {
+		r := timingRecord{}
+		// Skip a line partially written by an interrupted run.
+		if err := json.Unmarshal(s.Bytes(), &r); err == nil {
+			records = append(records, r)
+		}
+	}
+	return records, s.Err()
+}
+
+// percentile returns the p-th percentile of the sorted values, using the
+// nearest rank.
+func percentile(sorted []float64, p int) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	if i < 1 {
+		i = 1
+	}
+	return sorted[i-1]
+}
+
+// median returns the median of values, which doesn't have to be sorted.
+func median(values []float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	return percentile(sorted, 50)
+}
+
+// trend compares the median of the last trendRuns values to the median of the
+// trendRuns values before them.
+func trend(values []float64) string {
+	if len(values) < 2*trendRuns {
+		return "n/a"
+	}
+	recent := median(values[len(values)-trendRuns:])
+	before := median(values[len(values)-2*trendRuns : len(values)-trendRuns])
+	if before == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+.0f%%", (recent-before)/before*100)
+}
+
+// pkgStats is the distribution of the durations of a test package.
+type pkgStats struct {
+	name     string
+	runs     int
+	p50, p95 float64
+}
+
+type slowestFirst []pkgStats
+
+func (s slowestFirst) Len() int      { return len(s) }
+func (s slowestFirst) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s slowestFirst) Less(i, j int) bool {
+	if s[i].p95 != s[j].p95 {
+		return s[i].p95 > s[j].p95
+	}
+	return s[i].name < s[j].name
+}
+
+// stats prints, for each check that was recorded, how many times it ran, its
+// 50th and 95th percentile durations, its last duration and its trend, along
+// with the slowest test packages.
+func stats(name, path string) error {
+	config, err := getConfig(name)
+	if err != nil {
+		return err
+	}
+	records, err := readTimings(path)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		fmt.Printf("no run recorded yet\n")
+		return nil
+	}
+	byCheck := map[string][]float64{}
+	byPackage := map[string][]float64{}
+	for _, r := range records {
+		for _, c := range r.Checks {
+			byCheck[c.Name] = append(byCheck[c.Name], c.Duration)
+			for _, p := range c.Packages {
+				byPackage[p.Package] = append(byPackage[p.Package], p.Duration)
+			}
+		}
+	}
+	levels := map[string]int{}
+	for _, c := range config.AllChecks() {
+		levels[c.GetName()] = c.GetRunLevel()
+	}
+
+	fmt.Printf("%d runs since %s\n\n", len(records), records[0].Time.Local().Format("2006-01-02 15:04"))
+	fmt.Printf("%-16s %5s %5s %8s %8s %8s %6s\n", "check", "level", "runs", "p50", "p95", "last", "trend")
+	names := make([]string, 0, len(byCheck))
+	for n := range byCheck {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		values := byCheck[n]
+		sorted := append([]float64{}, values...)
+		sort.Float64s(sorted)
+		level := "-"
+		if l, ok := levels[n]; ok {
+			level = fmt.Sprintf("%d", l)
+		}
+		fmt.Printf("%-16s %5s %5d %7.2fs %7.2fs %7.2fs %6s\n", n, level, len(values), percentile(sorted, 50), percentile(sorted, 95), values[len(values)-1], trend(values))
+	}
+
+	if len(byPackage) == 0 {
+		return nil
+	}
+	pkgs := make([]pkgStats, 0, len(byPackage))
+	for n, values := range byPackage {
+		sort.Float64s(values)
+		pkgs = append(pkgs, pkgStats{n, len(values), percentile(values, 50), percentile(values, 95)})
+	}
+	sort.Sort(slowestFirst(pkgs))
+	if len(pkgs) > 10 {
+		pkgs = pkgs[:10]
+	}
+	fmt.Printf("\nslowest test packages:\n")
+	fmt.Printf("%-40s %5s %8s %8s\n", "package", "runs", "p50", "p95")
+	for _, p := range pkgs {
+		fmt.Printf("%-40s %5d %7.2fs %7.2fs\n", p.name, p.runs, p.p50, p.p95)
+	}
+	return nil
+}
@@ -7,18 +7,30 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
+
+	"github.com/maruel/pre-commit-go/checks"
 )
 
 // capture runs an executable and returns the output, exit code and error if
 // appropriate.
 func capture(args ...string) (string, int, error) {
+	return captureEnv(nil, args...)
+}
+
+// captureEnv is like capture() except that it adds environment variables.
+func captureEnv(env []string, args ...string) (string, int, error) {
 	exitCode := -1
 	log.Printf("capture(%s)", args)
 	c := exec.Command(args[0], args[1:]...)
+	if len(env) != 0 {
+		c.Env = append(os.Environ(), env...)
+	}
 	out, err := c.CombinedOutput()
 	if c.ProcessState != nil {
 		if waitStatus, ok := c.ProcessState.Sys().(syscall.WaitStatus); ok {
@@ -32,6 +44,27 @@ func capture(args ...string) (string, int, error) {
 	return string(out), exitCode, err
 }
 
+// cancelOnSignal calls cancel on the first interruption, which kills the
+// running checks and lets the tree be restored. A second interruption exits
+// right away, telling how to restore the tree if the pre-commit hook stashed
+// the unstaged changes.
+func cancelOnSignal(cancel func()) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		<-sig
+		log.Printf("interrupted")
+		cancel()
+		<-sig
+		if statePath, err := gitPath(stashStateFile); err == nil {
+			if _, err := os.Stat(statePath); err == nil {
+				fmt.Fprintf(os.Stderr, "pre-commit-go: interrupted while the unstaged changes are stashed; run 'pre-commit-go hook -recover' to restore them\n")
+			}
+		}
+		os.Exit(1)
+	}()
+}
+
 // captureAbs returns an absolute path of whatever a git command returned.
 func captureAbs(args ...string) (string, error) {
 	out, code, _ := capture(args...)
@@ -42,3 +75,73 @@ func captureAbs(args ...string) (string, error) {
 	log.Printf("captureAbs(%s) = %s", args, path)
 	return path, err
 }
+
+// gitPath returns the absolute path of file name in the .git directory.
+func gitPath(name string) (string, error) {
+	gitDir, err := captureAbs("git", "rev-parse", "--git-dir")
+	if err != nil {
+		return "", fmt.Errorf("failed to find .git dir: %s", err)
+	}
+	return filepath.Join(gitDir, name), nil
+}
+
+// runGit runs a git command and returns its output with the trailing new
+// lines trimmed.
+func runGit(args ...string) (string, error) {
+	return runGitEnv(nil, args...)
+}
+
+// runGitEnv is like runGit() except that it adds environment variables.
+func runGitEnv(env []string, args ...string) (string, error) {
+	out, code, err := captureEnv(env, append([]string{"git"}, args...)...)
+	out = strings.TrimRight(out, "\n")
+	if code != 0 {
+		return out, fmt.Errorf("git %s failed:\n%s", strings.Join(args, " "), out)
+	}
+	return out, err
+}
+
+// emptyTree is the git object of an empty tree, to diff against when there is
+// no parent commit.
+const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// headRev returns "HEAD" or the empty tree if there is no commit yet, which
+// is useful to diff against.
+func headRev() string {
+	if _, err := runGit("rev-parse", "--verify", "-q", "HEAD"); err != nil {
+		return emptyTree
+	}
+	return "HEAD"
+}
+
+// getChange returns the files modified since revision rev. If cached is
+// true, the content of the index is compared instead of the working tree.
+func getChange(rev string, cached bool) (*checks.Change, error) {
+	args := []string{"diff", "--name-only", "--no-renames", "-z"}
+	if cached {
+		args = append(args, "--cached")
+	}
+	return diffChange(append(args, rev, "--")...)
+}
+
+// getRangeChange returns the files modified between two revisions.
+func getRangeChange(base, tip string) (*checks.Change, error) {
+	return diffChange("diff", "--name-only", "--no-renames", "-z", base, tip, "--")
+}
+
+// diffChange runs a 'git diff --name-only -z' command and returns the files
+// listed.
+func diffChange(args ...string) (*checks.Change, error) {
+	out, err := runGit(args...)
+	if err != nil {
+		return nil, err
+	}
+	change := &checks.Change{Files: []string{}}
+	for _, f := range strings.Split(out, "\x00") {
+		if f != "" {
+			change.Files = append(change.Files, f)
+		}
+	}
+	log.Printf("diffChange(%s) = %s", args, change.Files)
+	return change, nil
+}
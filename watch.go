@@ -0,0 +1,191 @@
+// Copyright 2015 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/maruel/pre-commit-go/checks"
+)
+
+// pollInterval is how often the tree is scanned for modifications. The checks
+// are run once a scan finds no new modification, so that saving multiple
+// files at once triggers a single run.
+const pollInterval = 500 * time.Millisecond
+
+// fileState is what is compared to detect a modified file.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// snapshot maps the files of the tree, relative to its root, to their state.
+type snapshot map[string]fileState
+
+// takeSnapshot lists the files of the tree rooted at root. Like for the
+// checks, the directories starting with '.' or '_' are skipped.
+func takeSnapshot(root string) snapshot {
+	s := snapshot{}
+	var recurse func(dir string)
+	recurse = func(dir string) {
+		f, err := os.Open(dir)
+		if err != nil {
+			return
+		}
+		names, _ := f.Readdirnames(-1)
+		_ = f.Close()
+		for _, name := range names {
+			if name[0] == '.' || name[0] == '_' {
+				continue
+			}
+			p := filepath.Join(dir, name)
+			stat, err := os.Stat(p)
+			if err != nil {
+				continue
+			}
+			if stat.IsDir() {
+				recurse(p)
+			} else if rel, err := filepath.Rel(root, p); err == nil {
+				s[filepath.ToSlash(rel)] = fileState{stat.Size(), stat.ModTime()}
+			}
+		}
+	}
+	recurse(root)
+	return s
+}
+
+// modified returns the files added, modified or deleted in next, sorted.
+func (s snapshot) modified(next snapshot) []string {
+	out := []string{}
+	for p, state := range next {
+		if old, ok := s[p]; !ok || old.size != state.size || !old.modTime.Equal(state.modTime) {
+			out = append(out, p)
+		}
+	}
+	for p := range s {
+		if _, ok := next[p]; !ok {
+			out = append(out, p)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// watch runs the enabled checks every time files are saved, only on the
+// modified files and the packages affected by them, until ctx is done.
+//
+// Only the modifications to Go sources, to files in testdata directories and
+// to the configuration files trigger a run. A modified configuration file
+// triggers a run on the whole tree.
+func watch(ctx context.Context, name string, opts *options) error {
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("watching %s for modifications; press Ctrl-C to stop\n", root)
+	previous := takeSnapshot(root)
+	pending := map[string]bool{}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		current := takeSnapshot(root)
+		modified := previous.modified(current)
+		previous = current
+		if len(modified) != 0 {
+			// Wait for the editor to be done saving.
+			for _, f := range modified {
+				pending[f] = true
+			}
+			continue
+		}
+		files := []string{}
+		for f := range pending {
+			if isWatched(f, name) {
+				files = append(files, f)
+			}
+		}
+		pending = map[string]bool{}
+		if len(files) == 0 {
+			continue
+		}
+		sort.Strings(files)
+		if err := watchRun(ctx, name, opts, files); err != nil {
+			// Likely a broken configuration file, which may be fixed next.
+			fmt.Printf("%s %s\n", time.Now().Format("15:04:05"), err)
+		}
+	}
+}
+
+// isWatched returns true if a modification to file f, relative to the root,
+// triggers a run.
+func isWatched(f, configName string) bool {
+	return strings.HasSuffix(f, ".go") || isConfig(f, configName) ||
+		strings.HasPrefix(f, "testdata/") || strings.Contains(f, "/testdata/")
+}
+
+// isConfig returns true if file f, relative to the root, is the configuration
+// file or the one of a subtree.
+func isConfig(f, configName string) bool {
+	return f == filepath.ToSlash(configName) || path.Base(f) == filepath.Base(configName)
+}
+
+// watchRun runs the checks applying to the packages affected by the modified
+// files and prints a status line, followed by the output of the checks that
+// failed.
+func watchRun(ctx context.Context, name string, opts *options, files []string) error {
+	start := time.Now()
+	config, err := getConfig(name)
+	if err != nil {
+		return err
+	}
+	// Packages may have been added or removed.
+	checks.Rescan()
+	o := *opts
+	o.affectedOnly = true
+	change := &checks.Change{Files: files}
+	for _, f := range files {
+		if isConfig(f, name) {
+			// Any check may be affected.
+			change = nil
+			break
+		}
+	}
+	result, err := runChecks(ctx, config, &o, change)
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	statuses := []string{}
+	for _, c := range result.enabled {
+		status := "skipped"
+		if r := result.results[c.GetName()]; r != nil {
+			status = string(r.Status)
+		}
+		statuses = append(statuses, c.GetName()+" "+status)
+	}
+	what := files[0]
+	if len(files) > 1 {
+		what += fmt.Sprintf(" (+%d)", len(files)-1)
+	}
+	fmt.Printf("%s %s: %s in %1.2fs\n", start.Format("15:04:05"), what, strings.Join(statuses, ", "), time.Now().Sub(start).Seconds())
+	for _, name := range sortedNames(result.failed) {
+		fmt.Printf("%s\n", indent(result.failed[name].Error(), "  "))
+	}
+	return nil
+}